@@ -0,0 +1,295 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+type (
+	Claims map[string]interface{}
+
+	Config struct {
+		// Issuers lists accepted iss claims, any issuer is accepted when empty.
+		Issuers []string
+		// Audiences lists accepted aud claims, any audience is accepted when empty.
+		Audiences []string
+		// Algorithms lists accepted signing algorithms.
+		Algorithms []string
+		// Leeway is the allowed clock skew when checking exp and nbf.
+		Leeway time.Duration
+	}
+
+	Verifier struct {
+		keys   *KeySet
+		config Config
+	}
+
+	header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	algorithm struct {
+		hash   crypto.Hash
+		verify func(key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool
+	}
+)
+
+const tokenParts = 3
+
+var (
+	ErrMalformed          = errors.New("token is malformed")
+	ErrAlgorithm          = errors.New("token algorithm is not allowed")
+	ErrKeyNotFound        = errors.New("token signing key not found")
+	ErrSignature          = errors.New("token signature is invalid")
+	ErrExpired            = errors.New("token is expired")
+	ErrNotValidYet        = errors.New("token is not valid yet")
+	ErrIssuer             = errors.New("token issuer is not accepted")
+	ErrAudience           = errors.New("token audience is not accepted")
+	ErrUnknownAlgorithm   = errors.New("algorithm is not supported")
+	ErrNoAllowedAlgorithm = errors.New("no algorithms allowed")
+)
+
+var algorithms = map[string]algorithm{
+	"RS256": {hash: crypto.SHA256, verify: verifyPKCS1},
+	"RS384": {hash: crypto.SHA384, verify: verifyPKCS1},
+	"RS512": {hash: crypto.SHA512, verify: verifyPKCS1},
+	"PS256": {hash: crypto.SHA256, verify: verifyPSS},
+	"PS384": {hash: crypto.SHA384, verify: verifyPSS},
+	"PS512": {hash: crypto.SHA512, verify: verifyPSS},
+	"ES256": {hash: crypto.SHA256, verify: verifyECDSA},
+	"ES384": {hash: crypto.SHA384, verify: verifyECDSA},
+	"ES512": {hash: crypto.SHA512, verify: verifyECDSA},
+	"EdDSA": {verify: verifyEdDSA},
+}
+
+func NewVerifier(keys *KeySet, config Config) (*Verifier, error) {
+	if len(config.Algorithms) == 0 {
+		return nil, ErrNoAllowedAlgorithm
+	}
+
+	for _, a := range config.Algorithms {
+		if _, ok := algorithms[a]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, a)
+		}
+	}
+
+	return &Verifier{keys: keys, config: config}, nil
+}
+
+// Verify checks the signature and the registered claims
+// of the token and returns all of its claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != tokenParts {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if !contains(v.config.Algorithms, h.Alg) {
+		return nil, ErrAlgorithm
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	var (
+		alg    = algorithms[h.Alg]
+		signed = []byte(parts[0] + "." + parts[1])
+		digest = signed
+	)
+
+	if alg.hash != 0 {
+		d := alg.hash.New()
+		d.Write(signed)
+		digest = d.Sum(nil)
+	}
+
+	keys := v.keys.Lookup(h.Kid)
+	if len(keys) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	var ok bool
+
+	for _, k := range keys {
+		if ok = alg.verify(k, alg.hash, digest, sig); ok {
+			break
+		}
+	}
+
+	if !ok {
+		return nil, ErrSignature
+	}
+
+	var c Claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if err := v.validate(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (v *Verifier) validate(c Claims) error {
+	now := time.Now()
+
+	exp, ok := c.Time("exp")
+	if !ok || now.After(exp.Add(v.config.Leeway)) {
+		return ErrExpired
+	}
+
+	if nbf, ok := c.Time("nbf"); ok && now.Add(v.config.Leeway).Before(nbf) {
+		return ErrNotValidYet
+	}
+
+	if len(v.config.Issuers) > 0 && !contains(v.config.Issuers, c.String("iss")) {
+		return ErrIssuer
+	}
+
+	if len(v.config.Audiences) > 0 {
+		var found bool
+
+		for _, a := range c.Strings("aud") {
+			if found = contains(v.config.Audiences, a); found {
+				break
+			}
+		}
+
+		if !found {
+			return ErrAudience
+		}
+	}
+
+	return nil
+}
+
+// Decode returns the claims of the token without verifying it.
+// It must only be used for tokens coming from trusted sources.
+func Decode(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != tokenParts {
+		return nil, ErrMalformed
+	}
+
+	var c Claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, ErrMalformed
+	}
+
+	return c, nil
+}
+
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns the claim as a list of strings, a single
+// string is treated as a list with one element.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		s := make([]string, 0, len(v))
+
+		for i := range v {
+			if e, ok := v[i].(string); ok {
+				s = append(s, e)
+			}
+		}
+
+		return s
+	}
+
+	return nil
+}
+
+func (c Claims) Time(name string) (time.Time, bool) {
+	switch v := c[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return time.Unix(int64(f), 0), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("failed to decode segment: %w", err)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to unmarshal segment: %w", err)
+	}
+
+	return nil
+}
+
+func verifyPKCS1(key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	k, ok := key.(*rsa.PublicKey)
+	return ok && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+}
+
+func verifyPSS(key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	k, ok := key.(*rsa.PublicKey)
+	return ok && rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+}
+
+func verifyECDSA(key crypto.PublicKey, _ crypto.Hash, digest, sig []byte) bool {
+	k, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+
+	size := (k.Curve.Params().BitSize + 7) / 8
+	if len(sig) != 2*size {
+		return false
+	}
+
+	var (
+		r = new(big.Int).SetBytes(sig[:size])
+		s = new(big.Int).SetBytes(sig[size:])
+	)
+
+	return ecdsa.Verify(k, digest, r, s)
+}
+
+func verifyEdDSA(key crypto.PublicKey, _ crypto.Hash, message, sig []byte) bool {
+	k, ok := key.(ed25519.PublicKey)
+	return ok && ed25519.Verify(k, message, sig)
+}
+
+func contains(s []string, e string) bool {
+	for i := range s {
+		if s[i] == e {
+			return true
+		}
+	}
+
+	return false
+}
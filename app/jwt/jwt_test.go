@@ -0,0 +1,129 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newToken(t *testing.T, key ed25519.PrivateKey, alg, kid string, claims Claims) string {
+	t.Helper()
+
+	h, err := json.Marshal(header{Alg: alg, Kid: kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signed)))
+}
+
+func TestVerify(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewVerifier(&KeySet{
+		keys:        map[string]crypto.PublicKey{"k1": pub},
+		lastRefresh: time.Now(),
+	}, Config{
+		Issuers:    []string{"https://issuer.example.com"},
+		Audiences:  []string{"api", "admin"},
+		Algorithms: []string{"EdDSA", "ES256"},
+		Leeway:     time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		now   = time.Now()
+		valid = func(c Claims) Claims {
+			v := Claims{
+				"iss": "https://issuer.example.com",
+				"aud": "api",
+				"exp": now.Add(time.Hour).Unix(),
+			}
+
+			for k, e := range c {
+				if e == nil {
+					delete(v, k)
+				} else {
+					v[k] = e
+				}
+			}
+
+			return v
+		}
+	)
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", newToken(t, key, "EdDSA", "k1", valid(nil)), nil},
+		{"without key id", newToken(t, key, "EdDSA", "", valid(nil)), nil},
+		{"malformed", "token", ErrMalformed},
+		{"alg not allowed", newToken(t, key, "RS256", "k1", valid(nil)), ErrAlgorithm},
+		{"alg none", newToken(t, key, "none", "k1", valid(nil)), ErrAlgorithm},
+		{"alg of another key type", newToken(t, key, "ES256", "k1", valid(nil)), ErrSignature},
+		{"other key", newToken(t, other, "EdDSA", "k1", valid(nil)), ErrSignature},
+		{"unknown key id", newToken(t, key, "EdDSA", "k2", valid(nil)), ErrKeyNotFound},
+		{"other issuer", newToken(t, key, "EdDSA", "k1", valid(Claims{"iss": "https://other.example.com"})), ErrIssuer},
+		{"no issuer", newToken(t, key, "EdDSA", "k1", valid(Claims{"iss": nil})), ErrIssuer},
+		{"other audience", newToken(t, key, "EdDSA", "k1", valid(Claims{"aud": "other"})), ErrAudience},
+		{"one of the audiences", newToken(t, key, "EdDSA", "k1", valid(Claims{"aud": []string{"other", "admin"}})), nil},
+		{"no audience", newToken(t, key, "EdDSA", "k1", valid(Claims{"aud": nil})), ErrAudience},
+		{"no expiry", newToken(t, key, "EdDSA", "k1", valid(Claims{"exp": nil})), ErrExpired},
+		{"expired", newToken(t, key, "EdDSA", "k1", valid(Claims{"exp": now.Add(-2 * time.Minute).Unix()})), ErrExpired},
+		{"expired within the leeway", newToken(t, key, "EdDSA", "k1", valid(Claims{"exp": now.Add(-30 * time.Second).Unix()})), nil},
+		{"not valid yet", newToken(t, key, "EdDSA", "k1", valid(Claims{"nbf": now.Add(2 * time.Minute).Unix()})), ErrNotValidYet},
+		{"not valid yet within the leeway", newToken(t, key, "EdDSA", "k1", valid(Claims{"nbf": now.Add(30 * time.Second).Unix()})), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := v.Verify(tc.token)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+
+			if err == nil && c.String("iss") != "https://issuer.example.com" {
+				t.Fatalf("expected the claims of the token, got %v", c)
+			}
+		})
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		algorithms []string
+		err        error
+	}{
+		{"supported", []string{"RS256", "EdDSA"}, nil},
+		{"none", nil, ErrNoAllowedAlgorithm},
+		{"unknown", []string{"HS256"}, ErrUnknownAlgorithm},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewVerifier(&KeySet{}, Config{Algorithms: tc.algorithms}); !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
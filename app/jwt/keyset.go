@@ -0,0 +1,316 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpraski/api-gateway/app/metrics"
+)
+
+type (
+	// KeySet holds the public keys of a JWKS document loaded from a file
+	// or a URL. The keys are periodically refreshed in the background so
+	// that key rotations are picked up without restarting.
+	KeySet struct {
+		source string
+		client *http.Client
+		done   chan struct{}
+
+		mu          sync.RWMutex
+		keys        map[string]crypto.PublicKey
+		lastRefresh time.Time
+	}
+
+	jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+const (
+	// minRefreshInterval limits how often an unknown key ID may
+	// trigger an out of band refresh of the key set.
+	minRefreshInterval = 30 * time.Second
+	maxKeySetSize      = 1 << 20
+	refreshSuccess     = "success"
+	refreshFailure     = "failure"
+)
+
+var (
+	ErrNoKeys       = errors.New("key set contains no usable keys")
+	ErrKeySetStatus = errors.New("key set responded with unexpected status")
+
+	errExponent = errors.New("exponent is too large")
+)
+
+// NewKeySet loads the key set from source, which is either an http(s)
+// URL or a file path, and refreshes it every interval until closed.
+func NewKeySet(ctx context.Context, source string, interval time.Duration, client *http.Client) (*KeySet, error) {
+	k := KeySet{source: source, client: client, done: make(chan struct{})}
+
+	if err := k.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-k.done:
+				return
+			case <-ticker.C:
+				_ = k.refresh(context.Background())
+			}
+		}
+	}()
+
+	return &k, nil
+}
+
+func (k *KeySet) Close() { close(k.done) }
+
+// Lookup returns the keys matching the key ID, or all keys when
+// the token does not specify one. An unknown key ID triggers a
+// rate limited refresh in case the keys have been rotated.
+func (k *KeySet) Lookup(kid string) []crypto.PublicKey {
+	k.mu.RLock()
+	keys := k.lookup(kid)
+	k.mu.RUnlock()
+
+	if len(keys) > 0 || !k.claimRefresh() {
+		return keys
+	}
+
+	if err := k.refresh(context.Background()); err != nil {
+		return nil
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.lookup(kid)
+}
+
+func (k *KeySet) lookup(kid string) []crypto.PublicKey {
+	if kid != "" {
+		if key, ok := k.keys[kid]; ok {
+			return []crypto.PublicKey{key}
+		}
+
+		return nil
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// claimRefresh reports whether the caller may refresh the key set out of band.
+func (k *KeySet) claimRefresh() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if time.Since(k.lastRefresh) < minRefreshInterval {
+		return false
+	}
+
+	k.lastRefresh = time.Now()
+
+	return true
+}
+
+func (k *KeySet) refresh(ctx context.Context) error {
+	keys, err := k.load(ctx)
+	if err != nil {
+		metrics.JWKSRefreshes.WithLabelValues(refreshFailure).Inc()
+		return fmt.Errorf("failed to load key set from %s: %w", k.source, err)
+	}
+
+	metrics.JWKSRefreshes.WithLabelValues(refreshSuccess).Inc()
+
+	k.mu.Lock()
+	k.keys = keys
+	k.lastRefresh = time.Now()
+	k.mu.Unlock()
+
+	return nil
+}
+
+func (k *KeySet) load(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	if strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://") {
+		b, err = k.fetch(ctx)
+	} else {
+		b, err = os.ReadFile(k.source)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var s jwks
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key set: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(s.Keys))
+
+	for i := range s.Keys {
+		if s.Keys[i].Use != "" && s.Keys[i].Use != "sig" {
+			continue
+		}
+
+		key, err := s.Keys[i].publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %q: %w", s.Keys[i].Kid, err)
+		}
+
+		if key != nil {
+			keys[s.Keys[i].Kid] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return keys, nil
+}
+
+func (k *KeySet) fetch(ctx context.Context) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, k.source, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new request: %w", err)
+	}
+
+	s, err := k.client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform request: %w", err)
+	}
+
+	defer s.Body.Close()
+
+	if s.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %d", ErrKeySetStatus, s.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(s.Body, maxKeySetSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return b, nil
+}
+
+// publicKey returns nil for key types which cannot be used to verify signatures.
+func (j *jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if !e.IsInt64() {
+			return nil, errExponent
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var c elliptic.Curve
+
+		switch j.Crv {
+		case "P-256":
+			c = elliptic.P256()
+		case "P-384":
+			c = elliptic.P384()
+		case "P-521":
+			c = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("curve %q is not supported", j.Crv)
+		}
+
+		x, err := decodeInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !c.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", j.Crv)
+		}
+
+		return &ecdsa.PublicKey{Curve: c, X: x, Y: y}, nil
+
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("curve %q is not supported", j.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode x: %w", err)
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key size %d is invalid", len(x))
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode integer: %w", err)
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
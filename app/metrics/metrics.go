@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "api_gateway"
+
+const (
+	LabelRoute    = "route"
+	LabelTarget   = "target"
+	LabelUpstream = "upstream"
+	LabelEndpoint = "endpoint"
+	LabelCode     = "code"
+	LabelResult   = "result"
+	LabelReason   = "reason"
+	LabelProtocol = "protocol"
+	LabelState    = "state"
+	LabelMode     = "mode"
+)
+
+// Unmatched is the route label used for requests which did not match any route.
+const Unmatched = "unmatched"
+
+var (
+	registry = prometheus.NewRegistry()
+	factory  = promauto.With(registry)
+
+	Requests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of handled requests partitioned by route and status class.",
+	}, []string{LabelRoute, LabelCode})
+
+	RequestsInFlight = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "requests_in_flight",
+		Help:      "Number of requests currently being handled partitioned by route.",
+	}, []string{LabelRoute})
+
+	UpstreamLatency = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "Time until the upstream responded with headers partitioned by route, target and status class.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{LabelRoute, LabelTarget, LabelCode})
+
+	RateLimitDecisions = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_decisions_total",
+		Help:      "Number of rate limiting decisions partitioned by route and result.",
+	}, []string{LabelRoute, LabelResult})
+
+	RateLimitFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_failures_total",
+		Help:      "Number of requests the rate limiting strategy failed for partitioned by route and failure mode.",
+	}, []string{LabelRoute, LabelMode})
+
+	IdentityLatency = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "identity_lookup_duration_seconds",
+		Help:      "Duration of identity token lookups partitioned by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{LabelRoute})
+
+	IdentityFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "identity_lookup_failures_total",
+		Help:      "Number of failed identity token lookups partitioned by route and reason.",
+	}, []string{LabelRoute, LabelReason})
+
+	IdentityCacheLookups = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "identity_cache_lookups_total",
+		Help:      "Number of identity cache lookups partitioned by result.",
+	}, []string{LabelResult})
+
+	JWKSRefreshes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jwks_refreshes_total",
+		Help:      "Number of JWKS refreshes partitioned by result.",
+	}, []string{LabelResult})
+
+	Upgrades = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upgrades_total",
+		Help:      "Number of protocol upgrades (e.g. WebSocket) partitioned by route and protocol.",
+	}, []string{LabelRoute, LabelProtocol})
+
+	Retries = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Number of retried upstream requests partitioned by route and reason.",
+	}, []string{LabelRoute, LabelReason})
+
+	RetriesExhausted = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retry_budget_exhausted_total",
+		Help:      "Number of retries denied by the retry budget partitioned by route.",
+	}, []string{LabelRoute})
+
+	CircuitState = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breakers partitioned by route and target, 0 is closed, 1 half open and 2 open.",
+	}, []string{LabelRoute, LabelTarget})
+
+	CircuitTransitions = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Number of circuit breaker state changes partitioned by route, target and the new state.",
+	}, []string{LabelRoute, LabelTarget, LabelState})
+
+	CircuitRejections = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_rejections_total",
+		Help:      "Number of requests short-circuited by an open circuit breaker partitioned by route and target.",
+	}, []string{LabelRoute, LabelTarget})
+
+	MirrorLatency = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mirror_duration_seconds",
+		Help:      "Time until the mirror responded with headers partitioned by route and status class.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{LabelRoute, LabelCode})
+
+	MirrorResponses = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mirror_responses_total",
+		Help:      "Number of mirrored requests partitioned by route and whether the mirror responded with the status of the primary target.",
+	}, []string{LabelRoute, LabelResult})
+
+	UpstreamHealthy = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_endpoint_healthy",
+		Help:      "Whether the upstream endpoint passes active health checks partitioned by upstream and endpoint.",
+	}, []string{LabelUpstream, LabelEndpoint})
+
+	UpstreamEjections = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_ejections_total",
+		Help:      "Number of endpoints ejected after consecutive failures partitioned by upstream.",
+	}, []string{LabelUpstream})
+
+	ConfigReloads = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of configuration reload attempts partitioned by result.",
+	}, []string{LabelResult})
+
+	ConfigLastReload = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// Class returns the status class of the HTTP status code, e.g. 2xx.
+func Class(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
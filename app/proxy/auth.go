@@ -1,12 +1,18 @@
 package proxy
 
-import "fmt"
+import (
+	"fmt"
+)
 
 type (
 	authorization struct {
-		via    authzVia
-		from   authzFrom
-		policy authzPolicy
+		via     authzVia
+		from    authzFrom
+		policy  authzPolicy
+		partner *partnerAuthz
+		custom  *customAuthz
+		jwt     *jwtAuthz
+		require *requirement
 	}
 
 	authzVia int
@@ -19,6 +25,7 @@ type (
 const (
 	nullVia authzVia = iota
 	accessToken
+	jwtToken
 )
 
 const (
@@ -38,7 +45,7 @@ const (
 )
 
 var (
-	authzViaStrings    = []string{"null", "access token"}
+	authzViaStrings    = []string{"null", "access token", "jwt"}
 	authzFromStrings   = []string{"null", "header", "cookie"}
 	authzPolicyStrings = []string{"null", "allowed", "permitted", "enforced", "forbidden", "custom", "partner"}
 )
@@ -51,6 +58,38 @@ func (a authorization) String() string {
 	)
 }
 
+// claimsHeader is the header the claims of a JWT are passed in,
+// clients must not be able to set it on any route.
+func (a *authorization) claimsHeader() string {
+	if a.jwt != nil && a.jwt.claimsHeader != "" {
+		return a.jwt.claimsHeader
+	}
+
+	return defaultClaimsHeader
+}
+
+// passed lists the headers the authorization passes to the upstream.
+func (a *authorization) passed() []string {
+	h := []string{partnerIDHeader, a.claimsHeader()}
+
+	if a.custom != nil {
+		h = append(h, a.custom.responseHeaders...)
+	}
+
+	return h
+}
+
+// credentials lists the headers the authorization reads the credentials from.
+func (a *authorization) credentials() []string {
+	h := []string{"Authorization", "Cookie"}
+
+	if a.policy == partner && a.partner != nil {
+		h = append(h, a.partner.header, partnerIDHeader, partnerTimestampHeader, partnerSignatureHeader)
+	}
+
+	return h
+}
+
 func (a *authorization) validate() error {
 	if a.policy == nullPolicy {
 		return ErrNilPolicy
@@ -64,23 +103,74 @@ func (a *authorization) validate() error {
 		if a.via == nullVia {
 			return ErrNilVia
 		}
+
+		if a.via == jwtToken {
+			if a.jwt == nil {
+				return ErrNilJWT
+			}
+
+			if err := a.jwt.validate(); err != nil {
+				return fmt.Errorf("jwt configuration invalid: %w", err)
+			}
+		}
+	}
+
+	if a.require != nil {
+		if !a.identifies() {
+			return ErrRequireWithoutIdentity
+		}
+
+		if err := a.require.validate(); err != nil {
+			return fmt.Errorf("require configuration invalid: %w", err)
+		}
+	}
+
+	if a.policy == partner {
+		if a.partner == nil {
+			return ErrNilPartner
+		}
+
+		if err := a.partner.validate(); err != nil {
+			return fmt.Errorf("partner configuration invalid: %w", err)
+		}
+	}
+
+	if a.policy == custom {
+		if a.custom == nil {
+			return ErrNilCustom
+		}
+
+		if err := a.custom.validate(); err != nil {
+			return fmt.Errorf("custom configuration invalid: %w", err)
+		}
 	}
 
 	return nil
 }
 
-func parseAuthorization(r *configRoute) (authorization, error) {
+func (a *authorization) identifies() bool {
+	return a.policy == permitted || a.policy == enforced
+}
+
+func parseAuthorization(r *configRoute, res *resources) (authorization, error) {
 	var (
 		av authzVia
 		af authzFrom
 		ap authzPolicy
+		pa *partnerAuthz
+		ca *customAuthz
+		ja *jwtAuthz
+		rq *requirement
 	)
 
 	if r.Authorization != nil {
 		if r.Authorization.Via != nil {
-			if *r.Authorization.Via == "token" {
+			switch *r.Authorization.Via {
+			case "token":
 				av = accessToken
-			} else {
+			case "jwt":
+				av = jwtToken
+			default:
 				return authorization{}, fmt.Errorf("via %q is not valid", *r.Authorization.Via)
 			}
 		}
@@ -114,11 +204,43 @@ func parseAuthorization(r *configRoute) (authorization, error) {
 				return authorization{}, fmt.Errorf("policy %q is not valid", *r.Authorization.Policy)
 			}
 		}
+
+		if r.Authorization.Partner != nil {
+			var err error
+			if pa, err = parsePartner(r.Authorization.Partner, res.secrets); err != nil {
+				return authorization{}, fmt.Errorf("failed to parse partner: %w", err)
+			}
+		}
+
+		if r.Authorization.Custom != nil {
+			var err error
+			if ca, err = parseCustom(r.Authorization.Custom); err != nil {
+				return authorization{}, fmt.Errorf("failed to parse custom: %w", err)
+			}
+		}
+
+		if r.Authorization.JWT != nil {
+			var err error
+			if ja, err = parseJWT(r.Authorization.JWT, res.keySets); err != nil {
+				return authorization{}, fmt.Errorf("failed to parse jwt: %w", err)
+			}
+		}
+
+		if r.Authorization.Require != nil {
+			var err error
+			if rq, err = parseRequire(r.Authorization.Require); err != nil {
+				return authorization{}, fmt.Errorf("failed to parse require: %w", err)
+			}
+		}
 	}
 
 	return authorization{
-		via:    av,
-		from:   af,
-		policy: ap,
+		via:     av,
+		from:    af,
+		policy:  ap,
+		partner: pa,
+		custom:  ca,
+		jwt:     ja,
+		require: rq,
 	}, nil
 }
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestReservedHeaders checks that clients can't pass the headers set by
+// the authorization of any route, whatever the route they call.
+func TestReservedHeaders(t *testing.T) {
+	var received http.Header
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-User-Id", "authorized")
+	}))
+	defer auth.Close()
+
+	p, err := New(strings.NewReplacer("BACKEND", backend.URL, "AUTH", auth.URL).Replace(`
+routes:
+  - prefix: /open
+    target: BACKEND
+    authorization:
+      policy: allowed
+  - prefix: /custom
+    target: BACKEND
+    authorization:
+      policy: custom
+      custom:
+        url: AUTH
+        responseHeaders: [X-User-Id]
+`), nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		header string
+		want   string
+	}{
+		{"partner id on open route", "/open", partnerIDHeader, ""},
+		{"claims on open route", "/open", defaultClaimsHeader, ""},
+		{"custom header on open route", "/open", "X-User-Id", ""},
+		{"custom header on custom route", "/custom", "X-User-Id", "authorized"},
+		{"partner id on custom route", "/custom", partnerIDHeader, ""},
+		{"other header", "/open", "X-Other", "forged"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			received = nil
+
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			r.Header.Set(tc.header, "forged")
+
+			w := httptest.NewRecorder()
+			p.Handler().ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			if got := received.Get(tc.header); got != tc.want {
+				t.Fatalf("expected %s to be %q, got %q", tc.header, tc.want, got)
+			}
+		})
+	}
+}
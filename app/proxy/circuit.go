@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/mpraski/api-gateway/app/metrics"
+)
+
+type (
+	// circuitBreaker keeps a separate breaker for every target of the route.
+	// A breaker opens after consecutive failures or when the error rate in
+	// the window is exceeded, and lets a few probe requests through once the
+	// open duration has passed to find out whether the target has recovered.
+	circuitBreaker struct {
+		route               string
+		consecutiveFailures int
+		errorRate           float64
+		minRequests         int
+		window              time.Duration
+		openDuration        time.Duration
+		halfOpenRequests    int
+		fallback            fallback
+		logger              *logging.Logger
+
+		mu       sync.Mutex
+		breakers map[string]*breaker
+	}
+
+	breaker struct {
+		target string
+		policy *circuitBreaker
+
+		mu        sync.Mutex
+		state     circuitState
+		until     time.Time
+		window    time.Time
+		requests  int
+		errors    int
+		failures  int
+		probes    int
+		successes int
+	}
+
+	// fallback is the response sent while the circuit is open.
+	fallback struct {
+		status      int
+		contentType string
+		body        []byte
+	}
+
+	circuitState int
+
+	outcome int
+)
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	outcomeIgnored
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultCircuitMinRequests  = 20
+	defaultCircuitWindow       = 10 * time.Second
+	defaultCircuitOpenDuration = 30 * time.Second
+	defaultHalfOpenRequests    = 1
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitHalfOpen:
+		return "halfOpen"
+	case circuitOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// get returns the breaker of the target, creating it on first use.
+func (c *circuitBreaker) get(target string) *breaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[target]
+	if !ok {
+		b = &breaker{target: target, policy: c}
+		c.breakers[target] = b
+
+		metrics.CircuitState.WithLabelValues(c.route, target).Set(float64(circuitClosed))
+	}
+
+	return b
+}
+
+// respond writes the fallback response.
+func (c *circuitBreaker) respond(w http.ResponseWriter) {
+	if c.fallback.contentType != "" {
+		w.Header().Set("Content-Type", c.fallback.contentType)
+	}
+
+	w.WriteHeader(c.fallback.status)
+	_, _ = w.Write(c.fallback.body)
+}
+
+// allow reports whether a request may be sent to the target,
+// and whether the request probes a half open circuit.
+func (b *breaker) allow() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		return true, false
+	case circuitOpen:
+		if time.Now().Before(b.until) {
+			return false, false
+		}
+
+		b.transition(circuitHalfOpen)
+	case circuitHalfOpen:
+		break
+	}
+
+	if b.probes >= b.policy.halfOpenRequests {
+		return false, false
+	}
+
+	b.probes++
+
+	return true, true
+}
+
+// record accounts for the outcome of a request allowed by the breaker.
+func (b *breaker) record(o outcome, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probes--
+	}
+
+	switch b.state {
+	case circuitHalfOpen:
+		if !probe {
+			return
+		}
+
+		switch o {
+		case outcomeFailure:
+			b.transition(circuitOpen)
+		case outcomeSuccess:
+			if b.successes++; b.successes >= b.policy.halfOpenRequests {
+				b.transition(circuitClosed)
+			}
+		case outcomeIgnored:
+			break
+		}
+
+	case circuitClosed:
+		if o == outcomeIgnored {
+			return
+		}
+
+		if now := time.Now(); now.Sub(b.window) > b.policy.window {
+			b.window, b.requests, b.errors = now, 0, 0
+		}
+
+		b.requests++
+
+		if o == outcomeSuccess {
+			b.failures = 0
+			return
+		}
+
+		b.errors++
+		b.failures++
+
+		if b.tripped() {
+			b.transition(circuitOpen)
+		}
+
+	case circuitOpen:
+		break
+	}
+}
+
+func (b *breaker) tripped() bool {
+	p := b.policy
+
+	if p.consecutiveFailures > 0 && b.failures >= p.consecutiveFailures {
+		return true
+	}
+
+	return p.errorRate > 0 && b.requests >= p.minRequests &&
+		float64(b.errors) >= p.errorRate*float64(b.requests)
+}
+
+func (b *breaker) transition(to circuitState) {
+	from := b.state
+
+	b.state = to
+	b.requests, b.errors, b.failures, b.successes = 0, 0, 0, 0
+	b.window = time.Now()
+
+	if to == circuitOpen {
+		b.until = b.window.Add(b.policy.openDuration)
+	}
+
+	severity := logging.Info
+	if to == circuitOpen {
+		severity = logging.Warning
+	}
+
+	b.policy.logger.Log(logging.Entry{
+		Severity: severity,
+		Payload:  fmt.Sprintf("circuit breaker of route %s for target %s changed from %s to %s", b.policy.route, b.target, from, to),
+	})
+
+	metrics.CircuitState.WithLabelValues(b.policy.route, b.target).Set(float64(to))
+	metrics.CircuitTransitions.WithLabelValues(b.policy.route, b.target, to.String()).Inc()
+}
+
+// classify tells whether the upstream response counts against the target.
+// Requests cancelled by the client say nothing about the target.
+func classify(r *http.Request, res *http.Response, err error) outcome {
+	switch {
+	case err != nil && errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		return outcomeIgnored
+	case err != nil, res.StatusCode >= http.StatusInternalServerError:
+		return outcomeFailure
+	default:
+		return outcomeSuccess
+	}
+}
+
+func parseCircuitBreaker(c *configCircuitBreaker, route string, logger *logging.Logger) (*circuitBreaker, error) {
+	b := circuitBreaker{
+		route:               route,
+		consecutiveFailures: defaultConsecutiveFailures,
+		minRequests:         defaultCircuitMinRequests,
+		window:              defaultCircuitWindow,
+		openDuration:        defaultCircuitOpenDuration,
+		halfOpenRequests:    defaultHalfOpenRequests,
+		fallback: fallback{
+			status: http.StatusServiceUnavailable,
+			body:   []byte(http.StatusText(http.StatusServiceUnavailable)),
+		},
+		logger:   logger,
+		breakers: make(map[string]*breaker),
+	}
+
+	if c.ConsecutiveFailures != nil {
+		b.consecutiveFailures = *c.ConsecutiveFailures
+	}
+
+	if c.ErrorRate != nil {
+		b.errorRate = *c.ErrorRate
+	}
+
+	if c.MinRequests != nil {
+		b.minRequests = *c.MinRequests
+	}
+
+	if c.Window != nil {
+		b.window = *c.Window
+	}
+
+	if c.OpenDuration != nil {
+		b.openDuration = *c.OpenDuration
+	}
+
+	if c.HalfOpenRequests != nil {
+		b.halfOpenRequests = *c.HalfOpenRequests
+	}
+
+	if f := c.Fallback; f != nil {
+		if f.Status != nil {
+			b.fallback.status = *f.Status
+		}
+
+		if f.ContentType != nil {
+			b.fallback.contentType = *f.ContentType
+		}
+
+		if f.Body != nil {
+			b.fallback.body = []byte(*f.Body)
+		}
+	}
+
+	if b.consecutiveFailures < 0 || b.errorRate < 0 || b.errorRate > 1 ||
+		b.consecutiveFailures == 0 && b.errorRate == 0 ||
+		b.minRequests < 1 || b.window <= 0 || b.openDuration <= 0 || b.halfOpenRequests < 1 ||
+		b.fallback.status < http.StatusContinue || b.fallback.status > 599 {
+		return nil, ErrInvalidCircuitBreaker
+	}
+
+	return &b, nil
+}
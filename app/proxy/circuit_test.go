@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	type step struct {
+		// allow asks the breaker, the other steps record the outcome
+		allow   bool
+		outcome outcome
+		probe   bool
+		wait    bool
+		ok      bool
+		state   circuitState
+	}
+
+	var (
+		success = func(s circuitState) step { return step{outcome: outcomeSuccess, state: s} }
+		failure = func(s circuitState) step { return step{outcome: outcomeFailure, state: s} }
+		allowed = func(probe bool, s circuitState) step { return step{allow: true, ok: true, probe: probe, state: s} }
+		denied  = func(s circuitState) step { return step{allow: true, state: s} }
+		wait    = step{wait: true, state: circuitOpen}
+	)
+
+	for _, tc := range []struct {
+		name   string
+		policy *circuitBreaker
+		steps  []step
+	}{
+		{
+			name:   "consecutive failures open",
+			policy: &circuitBreaker{consecutiveFailures: 2},
+			steps: []step{
+				failure(circuitClosed),
+				success(circuitClosed),
+				failure(circuitClosed),
+				failure(circuitOpen),
+				denied(circuitOpen),
+			},
+		},
+		{
+			name:   "error rate opens",
+			policy: &circuitBreaker{errorRate: 0.5, minRequests: 4},
+			steps: []step{
+				failure(circuitClosed),
+				success(circuitClosed),
+				success(circuitClosed),
+				failure(circuitOpen),
+			},
+		},
+		{
+			name:   "ignored outcomes don't count",
+			policy: &circuitBreaker{consecutiveFailures: 1},
+			steps: []step{
+				{outcome: outcomeIgnored, state: circuitClosed},
+				failure(circuitOpen),
+			},
+		},
+		{
+			name:   "successful probe closes",
+			policy: &circuitBreaker{consecutiveFailures: 1, halfOpenRequests: 1},
+			steps: []step{
+				failure(circuitOpen),
+				wait,
+				allowed(true, circuitHalfOpen),
+				denied(circuitHalfOpen),
+				{outcome: outcomeSuccess, probe: true, state: circuitClosed},
+				allowed(false, circuitClosed),
+			},
+		},
+		{
+			name:   "failed probe opens again",
+			policy: &circuitBreaker{consecutiveFailures: 1, halfOpenRequests: 1},
+			steps: []step{
+				failure(circuitOpen),
+				wait,
+				allowed(true, circuitHalfOpen),
+				{outcome: outcomeFailure, probe: true, state: circuitOpen},
+				denied(circuitOpen),
+			},
+		},
+		{
+			name:   "requests which didn't probe are ignored when half open",
+			policy: &circuitBreaker{consecutiveFailures: 1, halfOpenRequests: 2},
+			steps: []step{
+				failure(circuitOpen),
+				wait,
+				allowed(true, circuitHalfOpen),
+				failure(circuitHalfOpen),
+				{outcome: outcomeSuccess, probe: true, state: circuitHalfOpen},
+				allowed(true, circuitHalfOpen),
+				{outcome: outcomeSuccess, probe: true, state: circuitClosed},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.policy
+			p.route = "/test"
+			p.window = time.Minute
+			p.openDuration = 20 * time.Millisecond
+			p.logger = newTestLogger(t)
+			p.breakers = make(map[string]*breaker)
+
+			if p.minRequests == 0 {
+				p.minRequests = 1
+			}
+
+			b := p.get("target")
+
+			for i, s := range tc.steps {
+				switch {
+				case s.wait:
+					time.Sleep(p.openDuration)
+				case s.allow:
+					if ok, probe := b.allow(); ok != s.ok || probe != s.probe {
+						t.Fatalf("step %d: expected allow to be %t and probe %t, got %t and %t", i, s.ok, s.probe, ok, probe)
+					}
+				default:
+					b.record(s.outcome, s.probe)
+				}
+
+				if b.state != s.state {
+					t.Fatalf("step %d: expected %s, got %s", i, s.state, b.state)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type (
+	// ipRanges is a list of addresses and networks, e.g. the trusted proxies
+	// in front of the gateway or the clients allowed to use a route.
+	ipRanges []netip.Prefix
+
+	// forwarding is how the request reached the gateway. The chain lists the
+	// client followed by the trusted proxies it passed, excluding the peer.
+	forwarding struct {
+		client  string
+		chain   []string
+		trusted bool
+	}
+
+	forwardingKey struct{}
+)
+
+func (r ipRanges) contains(ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	a = a.Unmap()
+
+	for _, p := range r {
+		if p.Contains(a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolve finds the real client IP. X-Forwarded-For can be set by anyone,
+// so it is only read if the peer is a trusted proxy, walking it from the
+// right up to the first address which is not a trusted proxy.
+func (r ipRanges) resolve(req *http.Request) forwarding {
+	peer := peerIP(req)
+
+	if !r.contains(peer) {
+		return forwarding{client: peer}
+	}
+
+	var hops []string
+
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hops = append(hops, h)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !r.contains(hops[i]) {
+			return forwarding{client: hops[i], chain: hops[i:], trusted: true}
+		}
+	}
+
+	// Every hop is trusted, the leftmost is as close to the client as it gets
+	if len(hops) > 0 {
+		return forwarding{client: hops[0], chain: hops, trusted: true}
+	}
+
+	return forwarding{client: peer, trusted: true}
+}
+
+// ClientIP returns the real client IP of a request handled by the proxy,
+// resolved through the trusted proxies, e.g. to key rate limits on.
+func ClientIP(r *http.Request) string {
+	if f := forwardingOf(r); f.client != "" {
+		return f.client
+	}
+
+	return peerIP(r)
+}
+
+func peerIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return strings.TrimSpace(r.RemoteAddr)
+	}
+
+	return ip
+}
+
+// forwardedFor formats the IP as a node of the Forwarded header.
+func forwardedFor(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return ip
+}
+
+func withForwarding(r *http.Request, f forwarding) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), forwardingKey{}, f))
+}
+
+func forwardingOf(r *http.Request) forwarding {
+	f, _ := r.Context().Value(forwardingKey{}).(forwarding)
+	return f
+}
+
+func parseIPRanges(c []string) (ipRanges, error) {
+	r := make(ipRanges, 0, len(c))
+
+	for _, s := range c {
+		s = strings.TrimSpace(s)
+
+		if !strings.Contains(s, "/") {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %q: %w", s, err)
+			}
+
+			a = a.Unmap()
+			r = append(r, netip.PrefixFrom(a, a.BitLen()))
+
+			continue
+		}
+
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %w", s, err)
+		}
+
+		r = append(r, p.Masked())
+	}
+
+	return r, nil
+}
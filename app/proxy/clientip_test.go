@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseIPRanges([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		peer  string
+		xff   []string
+		want  string
+		chain string
+	}{
+		{
+			name: "no proxy",
+			peer: "203.0.113.1",
+			want: "203.0.113.1",
+		},
+		{
+			name: "spoofed by an untrusted peer",
+			peer: "203.0.113.1",
+			xff:  []string{"198.51.100.1"},
+			want: "203.0.113.1",
+		},
+		{
+			name:  "trusted peer",
+			peer:  "10.0.0.1",
+			xff:   []string{"198.51.100.1"},
+			want:  "198.51.100.1",
+			chain: "198.51.100.1",
+		},
+		{
+			name:  "spoofed behind a trusted peer",
+			peer:  "10.0.0.1",
+			xff:   []string{"1.1.1.1, 198.51.100.1"},
+			want:  "198.51.100.1",
+			chain: "198.51.100.1",
+		},
+		{
+			name:  "walked from the right",
+			peer:  "10.0.0.1",
+			xff:   []string{"1.1.1.1, 198.51.100.1", "192.168.1.1, 10.0.0.2"},
+			want:  "198.51.100.1",
+			chain: "198.51.100.1,192.168.1.1,10.0.0.2",
+		},
+		{
+			name:  "every hop trusted",
+			peer:  "10.0.0.1",
+			xff:   []string{"10.0.0.3, 10.0.0.2"},
+			want:  "10.0.0.3",
+			chain: "10.0.0.3,10.0.0.2",
+		},
+		{
+			name: "trusted peer without the header",
+			peer: "10.0.0.1",
+			want: "10.0.0.1",
+		},
+		{
+			name:  "mapped addresses",
+			peer:  "::ffff:10.0.0.1",
+			xff:   []string{"2001:db8::1, ::ffff:192.168.1.1"},
+			want:  "2001:db8::1",
+			chain: "2001:db8::1,::ffff:192.168.1.1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.peer + ":1234"
+
+			if strings.Contains(tc.peer, ":") {
+				r.RemoteAddr = "[" + tc.peer + "]:1234"
+			}
+
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			f := trusted.resolve(r)
+
+			if got := ClientIP(withForwarding(r, f)); got != tc.want {
+				t.Fatalf("expected client %s, got %s", tc.want, got)
+			}
+
+			if got := strings.Join(f.chain, ","); got != tc.chain {
+				t.Fatalf("expected chain %q, got %q", tc.chain, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// customAuthz delegates the authorization decision to an external
+// endpoint (forward auth). A 2xx response of the endpoint admits the
+// request, any other response is relayed to the client.
+type customAuthz struct {
+	url             *url.URL
+	timeout         time.Duration
+	requestHeaders  []string
+	responseHeaders []string
+}
+
+const (
+	defaultCustomTimeout = 5 * time.Second
+	maxCustomBodySize    = 64 * 1024
+)
+
+func (p *Proxy) handleCustom(w http.ResponseWriter, r *http.Request, a *customAuthz) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+
+	areq, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url.String(), http.NoBody)
+	if err != nil {
+		p.logError(w, r, fmt.Errorf("failed to create custom authorization request: %w", err))
+		return false
+	}
+
+	if len(a.requestHeaders) == 0 {
+		copyHeader(areq.Header, r.Header)
+		removeConnectionHeaders(areq.Header)
+
+		for _, h := range hopHeaders {
+			areq.Header.Del(h)
+		}
+
+		areq.Header.Del("Content-Length")
+	} else {
+		for _, h := range a.requestHeaders {
+			for _, v := range r.Header.Values(h) {
+				areq.Header.Add(h, v)
+			}
+		}
+	}
+
+	areq.Header.Set("X-Forwarded-Method", r.Method)
+	areq.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	areq.Header.Set("X-Forwarded-Host", r.Host)
+
+	res, err := p.transport.RoundTrip(areq)
+	if err != nil {
+		p.logError(w, r, fmt.Errorf("custom authorization request failed: %w", err))
+		return false
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusOK && res.StatusCode < http.StatusMultipleChoices {
+		for _, h := range a.responseHeaders {
+			r.Header.Del(h)
+
+			for _, v := range res.Header.Values(h) {
+				r.Header.Add(h, v)
+			}
+		}
+
+		return true
+	}
+
+	removeConnectionHeaders(res.Header)
+
+	for _, h := range hopHeaders {
+		res.Header.Del(h)
+	}
+
+	res.Header.Del("Content-Length")
+
+	copyHeader(w.Header(), res.Header)
+	w.WriteHeader(res.StatusCode)
+
+	_, _ = io.Copy(w, io.LimitReader(res.Body, maxCustomBodySize))
+
+	return false
+}
+
+func (a *customAuthz) validate() error {
+	if a.url == nil {
+		return ErrNilCustomURL
+	}
+
+	return nil
+}
+
+func parseCustom(c *configCustom) (*customAuthz, error) {
+	a := customAuthz{timeout: defaultCustomTimeout}
+
+	if c.URL != nil {
+		u, err := url.Parse(*c.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse url: %w", err)
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("url %q must be absolute", *c.URL)
+		}
+
+		a.url = u
+	}
+
+	if c.Timeout != nil {
+		a.timeout = *c.Timeout
+	}
+
+	if c.RequestHeaders != nil {
+		for _, h := range *c.RequestHeaders {
+			a.requestHeaders = append(a.requestHeaders, http.CanonicalHeaderKey(strings.TrimSpace(h)))
+		}
+	}
+
+	if c.ResponseHeaders != nil {
+		for _, h := range *c.ResponseHeaders {
+			a.responseHeaders = append(a.responseHeaders, http.CanonicalHeaderKey(strings.TrimSpace(h)))
+		}
+	}
+
+	return &a, nil
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders tell the upstream how the request reached the gateway, so
+// that it can build absolute URLs. Values set by a trusted proxy in front of
+// the gateway are kept if trust is set, any other incoming values are replaced.
+type forwardedHeaders struct {
+	forwarded bool
+	proto     bool
+	host      bool
+	port      bool
+	prefix    bool
+	trust     bool
+}
+
+const (
+	headerForwarded       = "Forwarded"
+	headerForwardedProto  = "X-Forwarded-Proto"
+	headerForwardedHost   = "X-Forwarded-Host"
+	headerForwardedPort   = "X-Forwarded-Port"
+	headerForwardedPrefix = "X-Forwarded-Prefix"
+)
+
+var defaultForwardedHeaders = forwardedHeaders{
+	forwarded: true,
+	proto:     true,
+	host:      true,
+	port:      true,
+	prefix:    true,
+	trust:     true,
+}
+
+func (f *forwardedHeaders) parse(r *configRoute) {
+	c := r.ForwardedHeaders
+	if c == nil {
+		return
+	}
+
+	for _, o := range []struct {
+		dst *bool
+		src *bool
+	}{
+		{&f.forwarded, c.Forwarded},
+		{&f.proto, c.Proto},
+		{&f.host, c.Host},
+		{&f.port, c.Port},
+		{&f.prefix, c.Prefix},
+		{&f.trust, c.Trust},
+	} {
+		if o.src != nil {
+			*o.dst = *o.src
+		}
+	}
+}
+
+// apply sets the forwarding headers of the upstream request h.
+func (f *forwardedHeaders) apply(h http.Header, r *http.Request, m *match) {
+	var (
+		fw    = forwardingOf(r)
+		keep  = f.trust && fw.trusted
+		peer  = peerIP(r)
+		hops  = append(append([]string(nil), fw.chain...), peer)
+		proto = "http"
+		host  = r.Host
+	)
+
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	// Only the part of X-Forwarded-For added by trusted proxies is retained,
+	// the client could have put anything in front of it
+	h.Set("X-Forwarded-For", strings.Join(hops, ", "))
+	h.Set("X-Real-Ip", fw.client)
+
+	if keep {
+		if v := h.Get(headerForwardedProto); v != "" {
+			proto = v
+		}
+
+		if v := h.Get(headerForwardedHost); v != "" {
+			host = v
+		}
+	}
+
+	emit(h, headerForwardedProto, proto, f.proto, keep)
+	emit(h, headerForwardedHost, host, f.host, keep)
+	emit(h, headerForwardedPort, port(host, proto), f.port, keep)
+
+	prefix := m.prefix
+	if v := h.Get(headerForwardedPrefix); keep && v != "" {
+		prefix = strings.TrimSuffix(v, "/") + prefix
+	}
+
+	emit(h, headerForwardedPrefix, prefix, f.prefix, false)
+
+	switch v := h.Get(headerForwarded); {
+	case !f.forwarded && keep:
+		break
+	case !f.forwarded:
+		h.Del(headerForwarded)
+	case keep && v != "":
+		// Trusted proxies listed the hops up to the peer
+		h.Set(headerForwarded, v+", "+forwardedElement(peer, host, proto))
+	default:
+		h.Set(headerForwarded, forwardedElement(fw.client, host, proto))
+	}
+}
+
+// emit sets the header, keeping the value of a trusted proxy,
+// and drops the incoming value if the header is not emitted.
+func emit(h http.Header, name, value string, on, keep bool) {
+	switch {
+	case keep && h.Get(name) != "":
+		return
+	case on:
+		h.Set(name, value)
+	default:
+		h.Del(name)
+	}
+}
+
+func port(host, proto string) string {
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		return p
+	}
+
+	if proto == "https" {
+		return "443"
+	}
+
+	return "80"
+}
+
+// forwardedElement formats a RFC 7239 forwarded-element.
+func forwardedElement(ip, host, proto string) string {
+	return "for=" + forwardedFor(ip) + ";host=" + forwardedValue(host) + ";proto=" + proto
+}
+
+// forwardedValue quotes values which are not a token, e.g. hosts with a port.
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, ":[]\" ,;") {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+
+	return v
+}
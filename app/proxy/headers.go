@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// headerRules change the headers of requests or responses. Headers are
+// removed first, then set and finally added, so a route can set a header
+// removed by its parent.
+type headerRules struct {
+	add    map[string][]template
+	set    map[string]template
+	remove []string
+}
+
+// Header templates can use these variables besides the path parameters,
+// parameter names cannot contain dots, so the two never collide.
+const (
+	varClientIP    = "client.ip"
+	varRoutePrefix = "route.prefix"
+	varSubject     = "identity.subject"
+	varRequestID   = "request.id"
+)
+
+var headerVariables = []string{varClientIP, varRoutePrefix, varSubject, varRequestID}
+
+// inherit returns a copy of the rules, which a child route can extend.
+func (h *headerRules) inherit() headerRules {
+	c := headerRules{
+		add:    make(map[string][]template, len(h.add)),
+		set:    make(map[string]template, len(h.set)),
+		remove: append([]string(nil), h.remove...),
+	}
+
+	for k, v := range h.add {
+		c.add[k] = append([]template(nil), v...)
+	}
+
+	for k, v := range h.set {
+		c.set[k] = v
+	}
+
+	return c
+}
+
+func (h *headerRules) parse(c *configHeaders, params []string) error {
+	if c == nil {
+		return nil
+	}
+
+	if h.add == nil {
+		h.add, h.set = make(map[string][]template), make(map[string]template)
+	}
+
+	vars := append(append([]string(nil), params...), headerVariables...)
+
+	for _, k := range c.Remove {
+		k = http.CanonicalHeaderKey(k)
+
+		if !contains(h.remove, k) {
+			h.remove = append(h.remove, k)
+		}
+
+		// A parent value would be applied after the removal
+		delete(h.add, k)
+		delete(h.set, k)
+	}
+
+	for k, v := range c.Set {
+		t, err := parseTemplate(v, vars)
+		if err != nil {
+			return fmt.Errorf("failed to parse header %q: %w", k, err)
+		}
+
+		h.set[http.CanonicalHeaderKey(k)] = t
+	}
+
+	for k, v := range c.Add {
+		t, err := parseTemplate(v, vars)
+		if err != nil {
+			return fmt.Errorf("failed to parse header %q: %w", k, err)
+		}
+
+		k = http.CanonicalHeaderKey(k)
+		h.add[k] = append(h.add[k], t)
+	}
+
+	return nil
+}
+
+func (h *headerRules) empty() bool {
+	return len(h.add) == 0 && len(h.set) == 0 && len(h.remove) == 0
+}
+
+func (h *headerRules) apply(hdr http.Header, values map[string]string) {
+	for _, k := range h.remove {
+		hdr.Del(k)
+	}
+
+	for k, v := range h.set {
+		hdr.Set(k, v.expand(values, headerEscape))
+	}
+
+	for k, ts := range h.add {
+		for _, v := range ts {
+			hdr.Add(k, v.expand(values, headerEscape))
+		}
+	}
+}
+
+// values returns the path parameters and the variables header templates can use.
+func (m *match) values(r *http.Request) map[string]string {
+	v := make(map[string]string, len(m.params)+len(headerVariables))
+
+	for k, p := range m.params {
+		v[k] = p
+	}
+
+	v[varClientIP] = ClientIP(r)
+	v[varRoutePrefix] = m.route.prefix
+	v[varSubject] = m.claims.String("sub")
+	v[varRequestID] = requestIDOf(r)
+
+	return v
+}
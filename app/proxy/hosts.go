@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// router selects the route tree by the Host header of the request,
+	// requests to hosts which are not configured use the default tree.
+	router struct {
+		hosts     map[string]*virtualHost
+		wildcards []wildcardHost
+		fallback  *virtualHost
+		upstreams upstreams
+		trusted   ipRanges
+		requestID requestID
+		// reserved are the headers only the gateway passes to the upstreams.
+		reserved []string
+		// jwks are the sources of the key sets used by the routes.
+		jwks map[string]struct{}
+	}
+
+	virtualHost struct {
+		routes  *routes
+		welcome []byte
+	}
+
+	// wildcardHost matches any subdomain of suffix, e.g. *.example.com
+	// matches both api.example.com and v1.api.example.com.
+	wildcardHost struct {
+		suffix string
+		host   *virtualHost
+	}
+)
+
+const wildcardPrefix = "*."
+
+func parseRouter(configData string, res *resources) (*router, error) {
+	var c config
+
+	if err := yaml.NewDecoder(strings.NewReader(configData)).Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to decode config data: %w", err)
+	}
+
+	welcome, err := parseWelcome(c.Welcome, welcomeMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	ups, err := parseUpstreams(c.Upstreams, res.checks)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted, err := parseIPRanges(c.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trusted proxies: %w", err)
+	}
+
+	rid, err := parseRequestID(c.RequestID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forget the sources of a configuration which failed to parse
+	res.keySets.take()
+
+	rs, err := parseRoutes("", c.Routes, res, ups)
+	if err != nil {
+		return nil, err
+	}
+
+	r := router{
+		hosts:     make(map[string]*virtualHost, len(c.Hosts)),
+		fallback:  &virtualHost{routes: rs, welcome: welcome},
+		upstreams: ups,
+		trusted:   trusted,
+		requestID: rid,
+	}
+
+	for i := range c.Hosts {
+		if err := r.addHost(&c.Hosts[i], res, welcome); err != nil {
+			return nil, fmt.Errorf("host %q is invalid: %w", c.Hosts[i].Host, err)
+		}
+	}
+
+	// Longer suffixes are more specific
+	sort.Slice(r.wildcards, func(i, j int) bool {
+		return len(r.wildcards[i].suffix) > len(r.wildcards[j].suffix)
+	})
+
+	r.reserved = r.reservedHeaders()
+	r.jwks = res.keySets.take()
+
+	return &r, nil
+}
+
+func (r *router) addHost(c *configHost, res *resources, welcome []byte) error {
+	name := normalizeHost(c.Host)
+	if name == "" {
+		return ErrNilHost
+	}
+
+	if strings.Contains(strings.TrimPrefix(name, wildcardPrefix), "*") {
+		return ErrInvalidHost
+	}
+
+	w, err := parseWelcome(c.Welcome, welcome)
+	if err != nil {
+		return err
+	}
+
+	rs, err := parseRoutes(name, c.Routes, res, r.upstreams)
+	if err != nil {
+		return err
+	}
+
+	h := &virtualHost{routes: rs, welcome: w}
+
+	if strings.HasPrefix(name, wildcardPrefix) {
+		suffix := name[1:]
+
+		for _, o := range r.wildcards {
+			if o.suffix == suffix {
+				return ErrDuplicateHost
+			}
+		}
+
+		r.wildcards = append(r.wildcards, wildcardHost{suffix: suffix, host: h})
+
+		return nil
+	}
+
+	if _, ok := r.hosts[name]; ok {
+		return ErrDuplicateHost
+	}
+
+	r.hosts[name] = h
+
+	return nil
+}
+
+// reservedHeaders lists the headers the authorization of any route passes
+// to its upstream, which clients must not be able to set on other routes.
+func (r *router) reservedHeaders() []string {
+	reserved := []string{partnerIDHeader, defaultClaimsHeader}
+
+	add := func(rt *route) {
+		for _, h := range rt.authz.passed() {
+			if !contains(reserved, h) {
+				reserved = append(reserved, h)
+			}
+		}
+	}
+
+	r.fallback.routes.t.walk(add)
+
+	for _, h := range r.hosts {
+		h.routes.t.walk(add)
+	}
+
+	for _, w := range r.wildcards {
+		w.host.routes.t.walk(add)
+	}
+
+	return reserved
+}
+
+// host returns the virtual host serving the Host header,
+// exact matches take precedence over wildcards.
+func (r *router) host(hostport string) *virtualHost {
+	name := normalizeHost(hostport)
+
+	if h, ok := r.hosts[name]; ok {
+		return h
+	}
+
+	for _, w := range r.wildcards {
+		if strings.HasSuffix(name, w.suffix) {
+			return w.host
+		}
+	}
+
+	return r.fallback
+}
+
+// parseWelcome returns the welcome message, or nil
+// if it has been disabled with an empty string.
+func parseWelcome(w *string, fallback []byte) ([]byte, error) {
+	if w == nil {
+		return fallback, nil
+	}
+
+	if *w == "" {
+		return nil, nil
+	}
+
+	if !json.Valid([]byte(*w)) {
+		return nil, ErrInvalidWelcome
+	}
+
+	return []byte(*w), nil
+}
+
+func normalizeHost(hostport string) string {
+	h := hostport
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		h = host
+	}
+
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+}
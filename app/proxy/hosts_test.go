@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mpraski/api-gateway/app/metrics"
+)
+
+// TestRouteMetrics checks that the routes of the same prefix
+// on other hosts or for other methods are counted apart.
+func TestRouteMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, err := New(`
+routes:
+  - prefix: /metered
+    target: `+backend.URL+`
+    authorization:
+      policy: allowed
+hosts:
+  - host: api.example.com
+    routes:
+      - prefix: /metered
+        target: `+backend.URL+`
+        authorization:
+          policy: allowed
+      - prefix: /metered
+        methods: [post]
+        target: `+backend.URL+`
+        authorization:
+          policy: allowed
+`, nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host   string
+		method string
+		label  string
+	}{
+		{"other.com", http.MethodGet, "/metered"},
+		{"api.example.com", http.MethodGet, "api.example.com/metered"},
+		{"api.example.com", http.MethodPost, "api.example.com/metered POST"},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			c := metrics.Requests.WithLabelValues(tc.label, metrics.Class(http.StatusOK))
+			before := testutil.ToFloat64(c)
+
+			r := httptest.NewRequest(tc.method, "/metered", nil)
+			r.Host = tc.host
+
+			p.Handler().ServeHTTP(httptest.NewRecorder(), r)
+
+			if got := testutil.ToFloat64(c) - before; got != 1 {
+				t.Fatalf("expected 1 request labelled %q, got %v", tc.label, got)
+			}
+		})
+	}
+}
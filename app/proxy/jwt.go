@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpraski/api-gateway/app/jwt"
+)
+
+type (
+	jwtAuthz struct {
+		verifier     *jwt.Verifier
+		claimsHeader string
+	}
+
+	// keySets shares key sets between routes and configuration reloads,
+	// so that each JWKS source is loaded and refreshed only once.
+	keySets struct {
+		mu     sync.Mutex
+		client *http.Client
+		sets   map[string]*jwt.KeySet
+		// used are the sources asked for since they were last taken.
+		used map[string]struct{}
+	}
+)
+
+const (
+	defaultClaimsHeader = "X-Jwt-Claims"
+	jwksRefreshInterval = 5 * time.Minute
+	jwksTimeout         = 10 * time.Second
+)
+
+var defaultAlgorithms = []string{"RS256"}
+
+func newKeySets() *keySets {
+	return &keySets{
+		client: &http.Client{Timeout: jwksTimeout},
+		sets:   make(map[string]*jwt.KeySet),
+		used:   make(map[string]struct{}),
+	}
+}
+
+func (k *keySets) get(source string) (*jwt.KeySet, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.used[source] = struct{}{}
+
+	if s, ok := k.sets[source]; ok {
+		return s, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jwksTimeout)
+	defer cancel()
+
+	s, err := jwt.NewKeySet(ctx, source, jwksRefreshInterval, k.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key set: %w", err)
+	}
+
+	k.sets[source] = s
+
+	return s, nil
+}
+
+// take returns the sources asked for since the last call,
+// which are those of the configuration parsed in the meantime.
+func (k *keySets) take() map[string]struct{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	u := k.used
+	k.used = make(map[string]struct{})
+
+	return u
+}
+
+// retain closes the key sets of sources no longer in use,
+// so that they stop being refreshed.
+func (k *keySets) retain(sources map[string]struct{}) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for source, s := range k.sets {
+		if _, ok := sources[source]; !ok {
+			s.Close()
+			delete(k.sets, source)
+		}
+	}
+}
+
+// verify checks the token and passes its claims to the upstream.
+func (a *jwtAuthz) verify(r *http.Request, t string) (jwt.Claims, error) {
+	c, err := a.verifier.Verify(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	if a.claimsHeader == "" {
+		return c, nil
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal claims: %w", err)
+	}
+
+	r.Header.Set(a.claimsHeader, base64.RawURLEncoding.EncodeToString(b))
+
+	return c, nil
+}
+
+func (a *jwtAuthz) validate() error {
+	if a.verifier == nil {
+		return ErrNilJWKS
+	}
+
+	return nil
+}
+
+func parseJWT(c *configJWT, k *keySets) (*jwtAuthz, error) {
+	var (
+		a   = jwtAuthz{claimsHeader: defaultClaimsHeader}
+		cfg = jwt.Config{Algorithms: defaultAlgorithms}
+	)
+
+	if c.ClaimsHeader != nil {
+		a.claimsHeader = http.CanonicalHeaderKey(strings.TrimSpace(*c.ClaimsHeader))
+	}
+
+	if c.Issuers != nil {
+		cfg.Issuers = *c.Issuers
+	}
+
+	if c.Audiences != nil {
+		cfg.Audiences = *c.Audiences
+	}
+
+	if c.Algorithms != nil {
+		cfg.Algorithms = *c.Algorithms
+	}
+
+	if c.Leeway != nil {
+		cfg.Leeway = *c.Leeway
+	}
+
+	if c.JWKS == nil {
+		return &a, nil
+	}
+
+	s, err := k.get(*c.JWKS)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.verifier, err = jwt.NewVerifier(s, cfg); err != nil {
+		return nil, fmt.Errorf("failed to create verifier: %w", err)
+	}
+
+	return &a, nil
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mpraski/api-gateway/app/metrics"
+)
+
+// mirror copies a sample of the requests of a route to a secondary
+// target, e.g. to validate a rewritten service against live traffic.
+// Its responses are discarded, so it never affects the client.
+type mirror struct {
+	target      *url.URL
+	percentage  float64
+	maxBodySize int64
+	timeout     time.Duration
+	// credentials tells whether the credentials of the client
+	// and the identities passed by the gateway are mirrored.
+	credentials bool
+}
+
+const (
+	defaultMirrorPercentage  = 100
+	defaultMirrorMaxBodySize = 64 * 1024
+	defaultMirrorTimeout     = 5 * time.Second
+)
+
+const (
+	mirrorMatch    = "match"
+	mirrorMismatch = "mismatch"
+	mirrorError    = "error"
+	mirrorSkipped  = "skipped"
+)
+
+func (m *mirror) sample() bool {
+	return rand.Float64()*100 < m.percentage //nolint:gosec //not used for security
+}
+
+// sendMirror sends a copy of the request to the mirror in the background.
+// The returned channel takes the status of the primary response, which the
+// mirror response is compared against, it is nil if the request is not mirrored.
+func (p *Proxy) sendMirror(req, outreq *http.Request, m *match) chan<- int {
+	mr := m.route.mirror
+
+	if !buffer(outreq, mr.maxBodySize) {
+		metrics.MirrorResponses.WithLabelValues(m.route.id, mirrorSkipped).Inc()
+		return nil
+	}
+
+	// The mirror request outlives the client request
+	ctx, cancel := context.WithTimeout(context.Background(), mr.timeout)
+
+	mreq := outreq.Clone(ctx)
+	retarget(mreq.URL, mr.target, m.path, m.query, req.URL.RawQuery)
+
+	if !mr.credentials {
+		a := m.route.authz
+
+		for _, h := range append(a.credentials(), a.passed()...) {
+			mreq.Header.Del(h)
+		}
+	}
+
+	if outreq.GetBody != nil {
+		mreq.Body, _ = outreq.GetBody()
+	}
+
+	primary := make(chan int, 1)
+
+	go func(route string) {
+		defer cancel()
+
+		start := time.Now()
+
+		res, err := p.transport.RoundTrip(mreq)
+		if err != nil {
+			metrics.MirrorLatency.WithLabelValues(route, upstreamError).Observe(time.Since(start).Seconds())
+			metrics.MirrorResponses.WithLabelValues(route, mirrorError).Inc()
+
+			return
+		}
+
+		discard(res)
+
+		metrics.MirrorLatency.WithLabelValues(route, metrics.Class(res.StatusCode)).Observe(time.Since(start).Seconds())
+
+		select {
+		case s := <-primary:
+			result := mirrorMatch
+			if s != res.StatusCode {
+				result = mirrorMismatch
+			}
+
+			metrics.MirrorResponses.WithLabelValues(route, result).Inc()
+		case <-ctx.Done():
+		}
+	}(m.route.id)
+
+	return primary
+}
+
+func parseMirror(c *configMirror) (*mirror, error) {
+	if c.Target == "" {
+		return nil, ErrNilMirrorTarget
+	}
+
+	u, err := url.Parse(c.Target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target: %w", err)
+	}
+
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+
+	m := mirror{
+		target:      u,
+		percentage:  defaultMirrorPercentage,
+		maxBodySize: defaultMirrorMaxBodySize,
+		timeout:     defaultMirrorTimeout,
+	}
+
+	if c.Percentage != nil {
+		m.percentage = *c.Percentage
+	}
+
+	if c.MaxBodySize != nil {
+		m.maxBodySize = *c.MaxBodySize
+	}
+
+	if c.Timeout != nil {
+		m.timeout = *c.Timeout
+	}
+
+	if c.ForwardCredentials != nil {
+		m.credentials = *c.ForwardCredentials
+	}
+
+	if m.percentage < 0 || m.percentage > 100 || m.maxBodySize < 0 || m.timeout <= 0 {
+		return nil, ErrInvalidMirror
+	}
+
+	return &m, nil
+}
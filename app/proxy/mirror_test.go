@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestMirrorCredentials checks that the credentials of the client and the
+// identities passed by the gateway only reach the mirror when enabled.
+func TestMirrorCredentials(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-User-Id", "authorized")
+	}))
+	defer auth.Close()
+
+	mirrored := make(chan *http.Request, 1)
+
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r
+	}))
+	defer shadow.Close()
+
+	for _, tc := range []struct {
+		forward bool
+		want    map[string]string
+	}{
+		{false, map[string]string{"Authorization": "", "Cookie": "", "X-User-Id": "", "X-Other": "other"}},
+		{true, map[string]string{"Authorization": "token", "Cookie": "sid=session", "X-User-Id": "authorized", "X-Other": "other"}},
+	} {
+		t.Run("forward "+strconv.FormatBool(tc.forward), func(t *testing.T) {
+			p, err := New(`
+routes:
+  - prefix: /api
+    target: `+backend.URL+`?from=gateway
+    rewrite: /v1
+    authorization:
+      policy: custom
+      custom:
+        url: `+auth.URL+`
+        responseHeaders: [X-User-Id]
+    mirror:
+      target: `+shadow.URL+`?from=mirror
+      forwardCredentials: `+strconv.FormatBool(tc.forward)+`
+`, nil, nil, newTestLogger(t), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/x?q=1", nil)
+			r.Header.Set("Authorization", "token")
+			r.Header.Set("Cookie", "sid=session")
+			r.Header.Set("X-Other", "other")
+
+			p.Handler().ServeHTTP(httptest.NewRecorder(), r)
+
+			var m *http.Request
+
+			select {
+			case m = <-mirrored:
+			case <-time.After(time.Second):
+				t.Fatal("expected the request to be mirrored")
+			}
+
+			if got, want := m.URL.RequestURI(), "/v1/x?from=mirror&q=1"; got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+
+			for h, want := range tc.want {
+				if got := m.Header.Get(h); got != want {
+					t.Fatalf("expected %s to be %q, got %q", h, want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpraski/api-gateway/app/secret"
+)
+
+type (
+	// partnerAuthz authenticates machine clients either with a static
+	// API key or with an HMAC-SHA256 signature of the request.
+	partnerAuthz struct {
+		scheme      partnerScheme
+		header      string
+		keys        map[string][]byte
+		maxSkew     time.Duration
+		maxBodySize int64
+	}
+
+	partnerScheme int
+)
+
+const (
+	nullScheme partnerScheme = iota
+	apiKey
+	hmacSignature
+)
+
+const (
+	partnerIDHeader        = "X-Partner-Id"
+	partnerTimestampHeader = "X-Partner-Timestamp"
+	partnerSignatureHeader = "X-Partner-Signature"
+	defaultAPIKeyHeader    = "X-Api-Key"
+	defaultMaxSkew         = 5 * time.Minute
+	defaultMaxBodySize     = 1 << 20
+	secretTimeout          = 10 * time.Second
+)
+
+var (
+	errPartnerUnknown      = errors.New("partner is unknown")
+	errPartnerKeyInvalid   = errors.New("partner key is invalid")
+	errPartnerTimestamp    = errors.New("partner timestamp is invalid")
+	errPartnerSignature    = errors.New("partner signature is invalid")
+	errPartnerBodyTooLarge = errors.New("partner request body is too large")
+)
+
+func (p *Proxy) handlePartner(w http.ResponseWriter, r *http.Request, a *partnerAuthz) bool {
+	id, err := a.authenticate(r)
+
+	r.Header.Del("Authorization")
+	r.Header.Del(a.header)
+	r.Header.Del(partnerIDHeader)
+	r.Header.Del(partnerTimestampHeader)
+	r.Header.Del(partnerSignatureHeader)
+
+	if err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, errPartnerBodyTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		http.Error(w, http.StatusText(status), status)
+
+		return false
+	}
+
+	r.Header.Set(partnerIDHeader, id)
+
+	return true
+}
+
+// authenticate returns the ID of the partner which issued the request.
+func (a *partnerAuthz) authenticate(r *http.Request) (string, error) {
+	switch a.scheme {
+	case apiKey:
+		k := []byte(r.Header.Get(a.header))
+		if len(k) == 0 {
+			return "", errPartnerKeyInvalid
+		}
+
+		for id, key := range a.keys {
+			if subtle.ConstantTimeCompare(k, key) == 1 {
+				return id, nil
+			}
+		}
+
+		return "", errPartnerKeyInvalid
+
+	case hmacSignature:
+		id := r.Header.Get(partnerIDHeader)
+
+		key, ok := a.keys[id]
+		if !ok {
+			return "", errPartnerUnknown
+		}
+
+		ts := r.Header.Get(partnerTimestampHeader)
+
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return "", errPartnerTimestamp
+		}
+
+		if d := time.Since(time.Unix(sec, 0)); d > a.maxSkew || d < -a.maxSkew {
+			return "", errPartnerTimestamp
+		}
+
+		sig, err := hex.DecodeString(r.Header.Get(partnerSignatureHeader))
+		if err != nil {
+			return "", errPartnerSignature
+		}
+
+		body, err := a.readBody(r)
+		if err != nil {
+			return "", err
+		}
+
+		bodySum := sha256.Sum256(body)
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + ts + "\n" + hex.EncodeToString(bodySum[:])))
+
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return "", errPartnerSignature
+		}
+
+		return id, nil
+
+	case nullScheme:
+		break
+	}
+
+	return "", errPartnerKeyInvalid
+}
+
+// readBody buffers the request body so that it can be both
+// signed and forwarded to the upstream.
+func (a *partnerAuthz) readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, a.maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	if int64(len(b)) > a.maxBodySize {
+		return nil, errPartnerBodyTooLarge
+	}
+
+	_ = r.Body.Close()
+
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+
+	return b, nil
+}
+
+func (a *partnerAuthz) validate() error {
+	if a.scheme == nullScheme {
+		return ErrNilPartnerScheme
+	}
+
+	if len(a.keys) == 0 {
+		return ErrNoPartnerKeys
+	}
+
+	return nil
+}
+
+func parsePartner(c *configPartner, s secret.Source) (*partnerAuthz, error) {
+	a := partnerAuthz{
+		header:      defaultAPIKeyHeader,
+		keys:        make(map[string][]byte, len(c.Keys)),
+		maxSkew:     defaultMaxSkew,
+		maxBodySize: defaultMaxBodySize,
+	}
+
+	if c.Scheme != nil {
+		switch *c.Scheme {
+		case "apiKey":
+			a.scheme = apiKey
+		case "hmac":
+			a.scheme = hmacSignature
+		default:
+			return nil, fmt.Errorf("scheme %q is not valid", *c.Scheme)
+		}
+	}
+
+	if c.Header != nil {
+		a.header = http.CanonicalHeaderKey(strings.TrimSpace(*c.Header))
+	}
+
+	if c.MaxSkew != nil {
+		a.maxSkew = *c.MaxSkew
+	}
+
+	if c.MaxBodySize != nil {
+		a.maxBodySize = *c.MaxBodySize
+	}
+
+	if len(c.Keys) > 0 && s == nil {
+		return nil, ErrNoSecretSource
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+
+	for id, name := range c.Keys {
+		k, err := s.Get(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key of partner %q: %w", id, err)
+		}
+
+		if k = bytes.TrimSpace(k); len(k) == 0 {
+			return nil, fmt.Errorf("key of partner %q is empty", id)
+		}
+
+		a.keys[id] = k
+	}
+
+	return &a, nil
+}
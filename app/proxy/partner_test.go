@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signature(key, method, uri, ts, body string) string {
+	sum := sha256.Sum256([]byte(body))
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(method + "\n" + uri + "\n" + ts + "\n" + hex.EncodeToString(sum[:])))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPartnerHMAC(t *testing.T) {
+	a := partnerAuthz{
+		scheme:      hmacSignature,
+		keys:        map[string][]byte{"acme": []byte("acme-secret")},
+		maxSkew:     time.Minute,
+		maxBodySize: 16,
+	}
+
+	var (
+		now  = strconv.FormatInt(time.Now().Unix(), 10)
+		past = strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+		soon = strconv.FormatInt(time.Now().Add(2*time.Minute).Unix(), 10)
+		body = `{"id":1}`
+	)
+
+	for _, tc := range []struct {
+		name      string
+		partner   string
+		ts        string
+		body      string
+		signature string
+		err       error
+	}{
+		{
+			name:      "valid",
+			partner:   "acme",
+			ts:        now,
+			body:      body,
+			signature: signature("acme-secret", http.MethodPost, "/orders?page=1", now, body),
+		},
+		{
+			name:      "unknown partner",
+			partner:   "other",
+			ts:        now,
+			body:      body,
+			signature: signature("acme-secret", http.MethodPost, "/orders?page=1", now, body),
+			err:       errPartnerUnknown,
+		},
+		{
+			name:      "missing timestamp",
+			partner:   "acme",
+			body:      body,
+			signature: signature("acme-secret", http.MethodPost, "/orders?page=1", "", body),
+			err:       errPartnerTimestamp,
+		},
+		{
+			name:      "timestamp too old",
+			partner:   "acme",
+			ts:        past,
+			body:      body,
+			signature: signature("acme-secret", http.MethodPost, "/orders?page=1", past, body),
+			err:       errPartnerTimestamp,
+		},
+		{
+			name:      "timestamp in the future",
+			partner:   "acme",
+			ts:        soon,
+			body:      body,
+			signature: signature("acme-secret", http.MethodPost, "/orders?page=1", soon, body),
+			err:       errPartnerTimestamp,
+		},
+		{
+			name:      "signature not hex",
+			partner:   "acme",
+			ts:        now,
+			body:      body,
+			signature: "signature",
+			err:       errPartnerSignature,
+		},
+		{
+			name:      "wrong key",
+			partner:   "acme",
+			ts:        now,
+			body:      body,
+			signature: signature("other-secret", http.MethodPost, "/orders?page=1", now, body),
+			err:       errPartnerSignature,
+		},
+		{
+			name:      "other query",
+			partner:   "acme",
+			ts:        now,
+			body:      body,
+			signature: signature("acme-secret", http.MethodPost, "/orders?page=2", now, body),
+			err:       errPartnerSignature,
+		},
+		{
+			name:      "other body",
+			partner:   "acme",
+			ts:        now,
+			body:      body,
+			signature: signature("acme-secret", http.MethodPost, "/orders?page=1", now, `{"id":2}`),
+			err:       errPartnerSignature,
+		},
+		{
+			name:      "body too large",
+			partner:   "acme",
+			ts:        now,
+			body:      strings.Repeat("x", 17),
+			signature: signature("acme-secret", http.MethodPost, "/orders?page=1", now, strings.Repeat("x", 17)),
+			err:       errPartnerBodyTooLarge,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/orders?page=1", strings.NewReader(tc.body))
+			r.Header.Set(partnerIDHeader, tc.partner)
+			r.Header.Set(partnerTimestampHeader, tc.ts)
+			r.Header.Set(partnerSignatureHeader, tc.signature)
+
+			id, err := a.authenticate(r)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+
+			if err == nil && id != tc.partner {
+				t.Fatalf("expected partner %s, got %s", tc.partner, id)
+			}
+		})
+	}
+}
+
+func TestPartnerAPIKey(t *testing.T) {
+	a := partnerAuthz{
+		scheme: apiKey,
+		header: defaultAPIKeyHeader,
+		keys:   map[string][]byte{"acme": []byte("acme-secret"), "other": []byte("other-secret")},
+	}
+
+	for _, tc := range []struct {
+		key     string
+		partner string
+		err     error
+	}{
+		{"acme-secret", "acme", nil},
+		{"other-secret", "other", nil},
+		{"acme-secret-2", "", errPartnerKeyInvalid},
+		{"", "", errPartnerKeyInvalid},
+	} {
+		t.Run(tc.key, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(defaultAPIKeyHeader, tc.key)
+
+			id, err := a.authenticate(r)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+
+			if id != tc.partner {
+				t.Fatalf("expected partner %q, got %q", tc.partner, id)
+			}
+		})
+	}
+}
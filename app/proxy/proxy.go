@@ -2,24 +2,30 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
-	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/logging"
+	"github.com/mpraski/api-gateway/app/jwt"
+	"github.com/mpraski/api-gateway/app/metrics"
 	"github.com/mpraski/api-gateway/app/ratelimit"
+	"github.com/mpraski/api-gateway/app/secret"
 	"github.com/mpraski/api-gateway/app/token"
 	"golang.org/x/net/http/httpguts"
 )
 
 type Proxy struct {
 	pool        *bytesPool
-	routes      *routes
-	tokens      *token.Client
+	router      atomic.Pointer[router]
+	tokens      token.Provider
+	resources   *resources
 	logger      *logging.Logger
 	transport   *http.Transport
 	rateLimiter ratelimit.HandleFunc
@@ -30,6 +36,15 @@ const (
 	cookieName  = "blue-session"
 )
 
+const (
+	identityInvalid = "invalid_session"
+	tokenInvalid    = "invalid_token"
+	identityError   = "error"
+	upstreamError   = "error"
+	reloadSuccess   = "success"
+	reloadFailure   = "failure"
+)
+
 var (
 	welcomeMsg = []byte(`{"api": "BlueHealth"}`)
 	// Hop-by-hop headers. These are removed when sent to the backend.
@@ -50,30 +65,76 @@ var (
 	}
 )
 
-func New(configData string, tokens *token.Client, logger *logging.Logger, rateLimiter ratelimit.HandleFunc) (*Proxy, error) {
-	routes, err := parseRoutes(configData)
+func New(
+	configData string,
+	tokens token.Provider,
+	secrets secret.Source,
+	logger *logging.Logger,
+	rateLimiter ratelimit.HandleFunc,
+) (*Proxy, error) {
+	res := &resources{
+		secrets: secrets,
+		keySets: newKeySets(),
+		checks:  &http.Client{Transport: newTransport()},
+		logger:  logger,
+	}
+
+	router, err := parseRouter(configData, res)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse proxy routes: %w", err)
 	}
 
-	return &Proxy{
+	p := &Proxy{
 		pool:        newPool(),
-		routes:      routes,
 		tokens:      tokens,
+		resources:   res,
 		logger:      logger,
 		transport:   newTransport(),
 		rateLimiter: rateLimiter,
-	}, nil
+	}
+
+	p.router.Store(router)
+	router.upstreams.start()
+
+	return p, nil
+}
+
+// Reload parses the configuration and, only if it is valid, atomically
+// replaces the routes. Requests already in flight keep using the routes
+// they were matched against.
+func (p *Proxy) Reload(configData string) error {
+	router, err := parseRouter(configData, p.resources)
+	if err != nil {
+		// Drop the key sets loaded only for the rejected configuration
+		p.resources.keySets.retain(p.router.Load().jwks)
+		metrics.ConfigReloads.WithLabelValues(reloadFailure).Inc()
+
+		return fmt.Errorf("failed to parse proxy routes: %w", err)
+	}
+
+	p.router.Swap(router).upstreams.stop()
+	p.resources.keySets.retain(router.jwks)
+	router.upstreams.start()
+
+	metrics.ConfigReloads.WithLabelValues(reloadSuccess).Inc()
+	metrics.ConfigLastReload.SetToCurrentTime()
+
+	return nil
+}
+
+// Upstreams reports the health of the upstream pools of the current configuration.
+func (p *Proxy) Upstreams() []UpstreamStatus {
+	return p.router.Load().upstreams.status()
 }
 
 func (p *Proxy) Handler() http.Handler {
 	return http.HandlerFunc(p.handle)
 }
 
-func (p *Proxy) handleRoot(w http.ResponseWriter, r *http.Request) bool {
-	if r.Method == http.MethodGet && r.URL.Path == "/" {
+func (p *Proxy) handleRoot(w http.ResponseWriter, r *http.Request, h *virtualHost) bool {
+	if h.welcome != nil && r.Method == http.MethodGet && r.URL.Path == "/" {
 		w.Header().Set("Content-Type", "application/json")
-		_, _ = w.Write(welcomeMsg)
+		_, _ = w.Write(h.welcome)
 
 		return false
 	}
@@ -81,7 +142,7 @@ func (p *Proxy) handleRoot(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
-func (p *Proxy) handleRateLimit(w http.ResponseWriter, r *http.Request, m match) bool {
+func (p *Proxy) handleRateLimit(w http.ResponseWriter, r *http.Request, m *match) bool {
 	if p.rateLimiter == nil {
 		return true
 	}
@@ -91,12 +152,19 @@ func (p *Proxy) handleRateLimit(w http.ResponseWriter, r *http.Request, m match)
 	}
 
 	return p.rateLimiter(w, r, ratelimit.Config{
-		Limit:    m.route.rateLimit.limit,
-		Duration: m.route.rateLimit.duration,
+		Route:         m.route.id,
+		Namespace:     m.route.id,
+		Key:           m.route.rateLimit.compose(r, m),
+		Limit:         m.route.rateLimit.limit,
+		Duration:      m.route.rateLimit.duration,
+		Algorithm:     m.route.rateLimit.algorithm,
+		Failure:       m.route.rateLimit.failure,
+		Timeout:       m.route.rateLimit.timeout,
+		LegacyHeaders: m.route.rateLimit.legacy,
 	})
 }
 
-func (p *Proxy) handleCors(w http.ResponseWriter, r *http.Request, m match) bool {
+func (p *Proxy) handleCors(w http.ResponseWriter, r *http.Request, m *match) bool {
 	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 		if m.route.cors.enabled || m.route.cors.onlyPreflight {
 			if m.route.cors.handlePreflight(w, r) {
@@ -118,10 +186,13 @@ func (p *Proxy) handleCors(w http.ResponseWriter, r *http.Request, m match) bool
 	return true
 }
 
-func (p *Proxy) handleAuthorization(w http.ResponseWriter, r *http.Request, m match) bool {
+func (p *Proxy) handleAuthorization(w http.ResponseWriter, r *http.Request, m *match) bool {
 	switch m.route.authz.policy {
-	case custom, partner:
-		return true
+	case custom:
+		return p.handleCustom(w, r, m.route.authz.custom)
+
+	case partner:
+		return p.handlePartner(w, r, m.route.authz.partner)
 
 	case allowed:
 		r.Header.Del("Authorization")
@@ -132,11 +203,6 @@ func (p *Proxy) handleAuthorization(w http.ResponseWriter, r *http.Request, m ma
 		return false
 
 	case permitted, enforced:
-		if m.route.authz.via != accessToken {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return false
-		}
-
 		var (
 			t string
 			o bool
@@ -153,8 +219,12 @@ func (p *Proxy) handleAuthorization(w http.ResponseWriter, r *http.Request, m ma
 
 		r.Header.Del("Authorization")
 
+		// Anonymous requests are let through on permitted routes,
+		// unless the route requires specific claims
+		optional := m.route.authz.policy == permitted && m.route.authz.require == nil
+
 		if !o {
-			if m.route.authz.policy == permitted {
+			if optional {
 				return true
 			}
 
@@ -163,9 +233,24 @@ func (p *Proxy) handleAuthorization(w http.ResponseWriter, r *http.Request, m ma
 			return false
 		}
 
-		i, e := p.tokens.GetIdentity(r.Context(), t)
+		var (
+			i string
+			c jwt.Claims
+			e error
+		)
+
+		switch m.route.authz.via {
+		case accessToken:
+			i, e = p.getIdentity(r.Context(), m, t)
+		case jwtToken:
+			i = t
+			c, e = p.verifyJWT(r, m, t)
+		case nullVia:
+			e = ErrNilVia
+		}
+
 		if e != nil {
-			if m.route.authz.policy == permitted {
+			if optional {
 				return true
 			}
 
@@ -174,6 +259,20 @@ func (p *Proxy) handleAuthorization(w http.ResponseWriter, r *http.Request, m ma
 			return false
 		}
 
+		if c == nil {
+			// The identity token comes from a trusted service
+			c, _ = jwt.Decode(i)
+		}
+
+		m.claims = c
+
+		if q := m.route.authz.require; q != nil {
+			if reason, ok := q.check(c); !ok {
+				http.Error(w, http.StatusText(http.StatusForbidden)+": "+reason, http.StatusForbidden)
+				return false
+			}
+		}
+
 		r.Header.Set("Authorization", "Bearer "+i)
 
 		return true
@@ -186,43 +285,213 @@ func (p *Proxy) handleAuthorization(w http.ResponseWriter, r *http.Request, m ma
 	return false
 }
 
+func (p *Proxy) getIdentity(ctx context.Context, m *match, accessToken string) (string, error) {
+	start := time.Now()
+
+	i, err := p.tokens.GetIdentity(ctx, accessToken)
+
+	metrics.IdentityLatency.WithLabelValues(m.route.id).Observe(time.Since(start).Seconds())
+
+	switch {
+	case errors.Is(err, token.ErrInvalidSession):
+		metrics.IdentityFailures.WithLabelValues(m.route.id, identityInvalid).Inc()
+	case err != nil:
+		metrics.IdentityFailures.WithLabelValues(m.route.id, identityError).Inc()
+	}
+
+	return i, err
+}
+
+func (p *Proxy) verifyJWT(r *http.Request, m *match, t string) (jwt.Claims, error) {
+	c, err := m.route.authz.jwt.verify(r, t)
+	if err != nil {
+		metrics.IdentityFailures.WithLabelValues(m.route.id, tokenInvalid).Inc()
+		return nil, err
+	}
+
+	return c, nil
+}
+
 func (p *Proxy) handleResponse(r *http.Response) {
 	if r.StatusCode >= http.StatusInternalServerError {
 		p.logger.Log(logging.Entry{
 			Severity: logging.Error,
 			Payload:  "upstream failed",
+			Labels:   logLabels(r.Request),
 			HTTPRequest: &logging.HTTPRequest{
 				Request:  r.Request,
 				Status:   r.StatusCode,
-				RemoteIP: r.Header.Get("X-Forwarded-For"),
+				RemoteIP: ClientIP(r.Request),
 			},
 		})
 	}
 }
 
-func (p *Proxy) modifyRequest(m match, req *http.Request) {
+func (p *Proxy) modifyRequest(m *match, req *http.Request) {
+	retarget(req.URL, m.target, m.path, m.query, req.URL.RawQuery)
+
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+// roundTrip sends the request upstream, retrying it according to the
+// retry policy of the route. Upgrade requests are never retried.
+func (p *Proxy) roundTrip(req *http.Request, m *match, retry bool) (*http.Response, error) {
 	var (
-		targetScheme = m.route.target.Scheme
-		targetQuery  = m.route.target.RawQuery
+		rp       = m.route.retries
+		attempts = 1
+	)
+
+	if rp != nil && retry {
+		rp.budget.deposit()
+
+		if rp.prepare(req) {
+			attempts = rp.attempts
+		}
+	}
+
+	for i := 1; ; i++ {
+		var (
+			ctx     = req.Context()
+			cancel  = func() {}
+			attempt *attemptContext
+		)
+
+		// Both timeouts cover the attempt until the response headers arrive
+		d := m.route.timeouts.responseHeader
+		if attempts > 1 && rp.perTryTimeout > 0 && (d == 0 || rp.perTryTimeout < d) {
+			d = rp.perTryTimeout
+		}
+
+		if d > 0 {
+			attempt, cancel = withAttemptTimeout(ctx, d)
+			ctx = attempt
+		}
+
+		res, err := p.try(req.WithContext(ctx), m)
+
+		if attempt != nil {
+			attempt.stop()
+		}
+
+		// Only the failures caused by a deadline are timeouts, the request
+		// timeout ends the exchange and is reported as it is
+		timedOut := errors.Is(err, context.DeadlineExceeded)
+		if timedOut && req.Context().Err() == nil {
+			err = fmt.Errorf("%w: no response within %s: %w", errUpstreamTimeout, d, err)
+		}
+
+		if c := m.route.circuit; c != nil {
+			// Only the first attempt probes the breaker which allowed the request
+			b := c.get(m.target.String())
+			b.record(classify(req, res, err), m.probe && b == m.breaker)
+			m.probe = false
+		}
+
+		reason, ok := "", false
+		if i < attempts {
+			reason, ok = rp.retryable(req, res, err, timedOut)
+		}
+
+		if ok && !rp.budget.withdraw() {
+			metrics.RetriesExhausted.WithLabelValues(m.route.id).Inc()
+			ok = false
+		}
+
+		if !ok {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+
+			// The body of an upgrade is the connection, which has to stay writable,
+			// its context is released once the handler returns
+			if res.StatusCode != http.StatusSwitchingProtocols {
+				res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+			}
+
+			return res, nil
+		}
+
+		if err == nil {
+			discard(res)
+		}
+
+		cancel()
+
+		metrics.Retries.WithLabelValues(m.route.id, reason).Inc()
+
+		if err := rp.wait(req.Context(), i); err != nil {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			req.Body, _ = req.GetBody()
+		}
+
+		if u := m.route.upstream; u != nil {
+			if e := u.pick(req, m); e != nil {
+				m.endpoint.release()
+				m.endpoint, m.target = e, e.url
+				e.acquire()
+
+				req.URL.Scheme, req.URL.Host = e.url.Scheme, e.url.Host
+			}
+		}
+	}
+}
+
+// try performs a single attempt of the upstream request.
+func (p *Proxy) try(req *http.Request, m *match) (*http.Response, error) {
+	start := time.Now()
+
+	res, err := p.transport.RoundTrip(req)
+
+	if m.endpoint != nil {
+		var status int
+		if err == nil {
+			status = res.StatusCode
+		}
+
+		m.route.upstream.observe(m.endpoint, status, err)
+	}
+
+	if err != nil {
+		metrics.UpstreamLatency.WithLabelValues(m.route.id, m.targetName, upstreamError).Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+
+	metrics.UpstreamLatency.WithLabelValues(m.route.id, m.targetName, metrics.Class(res.StatusCode)).Observe(time.Since(start).Seconds())
+
+	return res, nil
+}
+
+// retarget points the URL at the target with the given path,
+// the query of the target goes before the given queries.
+func retarget(u, target *url.URL, path string, queries ...string) {
+	var (
+		targetScheme = target.Scheme
+		targetQuery  = target.RawQuery
 	)
 
 	if targetScheme == "" {
 		targetScheme = "http"
 	}
 
-	req.URL.Path = m.path
-	req.URL.Host = m.route.target.Host
-	req.URL.Scheme = targetScheme
+	u.Path = path
+	u.Host = target.Host
+	u.Scheme = targetScheme
 
-	if targetQuery == "" || req.URL.RawQuery == "" {
-		req.URL.RawQuery = targetQuery + req.URL.RawQuery
-	} else {
-		req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+	for _, q := range queries {
+		if targetQuery == "" || q == "" {
+			targetQuery += q
+		} else {
+			targetQuery += "&" + q
+		}
 	}
 
-	if _, ok := req.Header["User-Agent"]; !ok {
-		req.Header.Set("User-Agent", "")
-	}
+	u.RawQuery = targetQuery
 }
 
 func (p *Proxy) getFlushInterval(res *http.Response) time.Duration {
@@ -245,7 +514,7 @@ func (p *Proxy) getFlushInterval(res *http.Response) time.Duration {
 	return 0
 }
 
-func (p *Proxy) copyResponse(dst io.Writer, src io.Reader, flushInterval time.Duration) error {
+func (p *Proxy) copyResponse(req *http.Request, dst io.Writer, src io.Reader, flushInterval time.Duration) error {
 	if flushInterval != 0 {
 		if wf, ok := dst.(writeFlusher); ok {
 			mlw := &maxLatencyWriter{
@@ -266,20 +535,24 @@ func (p *Proxy) copyResponse(dst io.Writer, src io.Reader, flushInterval time.Du
 	b := p.pool.Get()
 	defer p.pool.Put(b)
 
-	_, err := p.copyBuffer(dst, src, *b)
+	_, err := p.copyBuffer(req, dst, src, *b)
 
 	return err
 }
 
 // copyBuffer returns any write errors or non-EOF read errors, and the amount
 // of bytes written.
-func (p *Proxy) copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+func (p *Proxy) copyBuffer(req *http.Request, dst io.Writer, src io.Reader, buf []byte) (int64, error) {
 	var written int64
 
 	for {
 		nr, rerr := src.Read(buf)
 		if rerr != nil && rerr != io.EOF && rerr != context.Canceled {
-			p.logger.StandardLogger(logging.Error).Printf("httputil: Proxy read error during body copy: %v", rerr)
+			p.logger.Log(logging.Entry{
+				Severity: logging.Error,
+				Payload:  fmt.Sprintf("httputil: Proxy read error during body copy: %v", rerr),
+				Labels:   logLabels(req),
+			})
 		}
 
 		if nr > 0 {
@@ -380,17 +653,60 @@ func (p *Proxy) handleUpgradeResponse(rw http.ResponseWriter, req *http.Request,
 }
 
 func (p *Proxy) handle(rw http.ResponseWriter, req *http.Request) {
-	if !p.handleRoot(rw, req) {
+	rt := p.router.Load()
+
+	id := rt.requestID.resolve(req)
+	rw.Header().Set(rt.requestID.header, id)
+
+	req = withRequestID(withForwarding(req, rt.trusted.resolve(req)), id)
+
+	h := rt.host(req.Host)
+
+	if !p.handleRoot(rw, req, h) {
 		return
 	}
 
-	m, ok := p.routes.match(req.URL.Path)
+	m, allow, ok := h.routes.match(routingMethod(req), req.URL.Path)
 	if !ok {
-		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		status := http.StatusNotFound
+		if len(allow) > 0 {
+			status = http.StatusMethodNotAllowed
+			rw.Header().Set("Allow", strings.Join(allow, ", "))
+		}
+
+		metrics.Requests.WithLabelValues(metrics.Unmatched, metrics.Class(status)).Inc()
+		http.Error(rw, http.StatusText(status), status)
+
+		return
+	}
+
+	// Only the gateway may pass identities, clients can only send
+	// the credentials the authorization of the route reads
+	for _, h := range rt.reserved {
+		if !contains(m.route.authz.credentials(), h) {
+			req.Header.Del(h)
+		}
+	}
+
+	sw := &statusWriter{ResponseWriter: rw}
+	rw = sw
+
+	metrics.RequestsInFlight.WithLabelValues(m.route.id).Inc()
+
+	defer func() {
+		metrics.RequestsInFlight.WithLabelValues(m.route.id).Dec()
+		metrics.Requests.WithLabelValues(m.route.id, metrics.Class(sw.code())).Inc()
+	}()
+
+	if ips := m.route.allowedIPs; len(ips) > 0 && !ips.contains(ClientIP(req)) {
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
 
-	if !p.handleRateLimit(rw, req, m) {
+	// Keys made of the identity of the client are only known once authorized
+	identity := m.route.rateLimit.identity()
+
+	if !identity && !p.handleRateLimit(rw, req, m) {
 		return
 	}
 
@@ -402,10 +718,47 @@ func (p *Proxy) handle(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	var (
-		ctx    = req.Context()
-		outreq = req.Clone(ctx)
-	)
+	if identity && !p.handleRateLimit(rw, req, m) {
+		return
+	}
+
+	if s := m.route.split; s != nil {
+		t := s.pick(rw, req, m)
+		m.target, m.targetName = t.url, t.name
+	}
+
+	if u := m.route.upstream; u != nil {
+		if m.endpoint = u.pick(req, m); m.endpoint == nil {
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		m.target = m.endpoint.url
+
+		m.endpoint.acquire()
+
+		// Retries may move the request to another endpoint
+		defer func() { m.endpoint.release() }()
+	}
+
+	if c := m.route.circuit; c != nil {
+		var ok bool
+
+		m.breaker = c.get(m.target.String())
+		if ok, m.probe = m.breaker.allow(); !ok {
+			metrics.CircuitRejections.WithLabelValues(m.route.id, m.breaker.target).Inc()
+			c.respond(rw)
+
+			return
+		}
+	}
+
+	m.route.timeouts.extend(rw)
+
+	ctx, cancel := m.route.timeouts.context(req.Context())
+	defer cancel()
+
+	outreq := req.Clone(ctx)
 
 	if req.ContentLength == 0 {
 		outreq.Body = nil // Issue 16036: nil Body for http.Transport retries
@@ -456,25 +809,22 @@ func (p *Proxy) handle(rw http.ResponseWriter, req *http.Request) {
 		outreq.Header.Set("Upgrade", reqUpType)
 	}
 
-	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		// If we aren't the first proxy retain prior
-		// X-Forwarded-For information as a comma+space
-		// separated list and fold multiple headers into one.
-		var (
-			prior, ok = outreq.Header["X-Forwarded-For"]
-			omit      = ok && prior == nil // Issue 38079: nil now means don't populate the header
-		)
+	m.route.forwarded.apply(outreq.Header, req, m)
 
-		if len(prior) > 0 {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
-		}
+	var values map[string]string
+	if !m.route.requestHeaders.empty() || !m.route.responseHeaders.empty() {
+		values = m.values(req)
+	}
+
+	m.route.requestHeaders.apply(outreq.Header, values)
 
-		if !omit {
-			outreq.Header.Set("X-Forwarded-For", clientIP)
+	if mr := m.route.mirror; mr != nil && reqUpType == "" && mr.sample() {
+		if primary := p.sendMirror(req, outreq, m); primary != nil {
+			defer func() { primary <- sw.code() }()
 		}
 	}
 
-	res, err := p.transport.RoundTrip(outreq)
+	res, err := p.roundTrip(outreq, m, reqUpType == "")
 	if err != nil {
 		p.logError(rw, outreq, err)
 		return
@@ -482,18 +832,27 @@ func (p *Proxy) handle(rw http.ResponseWriter, req *http.Request) {
 
 	// Deal with 101 Switching Protocols responses: (WebSocket, h2c, etc)
 	if res.StatusCode == http.StatusSwitchingProtocols {
+		metrics.Upgrades.WithLabelValues(m.route.id, upgradeType(res.Header)).Inc()
 		p.handleResponse(res)
 		p.handleUpgradeResponse(rw, outreq, res)
 
 		return
 	}
 
+	res.Body = m.route.timeouts.watch(res.Body, cancel)
+
 	removeConnectionHeaders(res.Header)
 
 	for _, h := range hopHeaders {
 		res.Header.Del(h)
 	}
 
+	// The request ID has already been set on the response
+	res.Header.Del(rt.requestID.header)
+
+	m.route.security.apply(res.Header)
+	m.route.responseHeaders.apply(res.Header, values)
+
 	p.handleResponse(res)
 
 	copyHeader(rw.Header(), res.Header)
@@ -513,10 +872,14 @@ func (p *Proxy) handle(rw http.ResponseWriter, req *http.Request) {
 
 	rw.WriteHeader(res.StatusCode)
 
-	if err = p.copyResponse(rw, res.Body, p.getFlushInterval(res)); err != nil {
+	if err = p.copyResponse(req, rw, res.Body, p.getFlushInterval(res)); err != nil {
 		defer res.Body.Close()
 
-		p.logger.StandardLogger(logging.Error).Printf("aborting with incomplete response: %v", err)
+		p.logger.Log(logging.Entry{
+			Severity: logging.Error,
+			Payload:  fmt.Sprintf("aborting with incomplete response: %v", err),
+			Labels:   logLabels(req),
+		})
 
 		return
 	}
@@ -547,15 +910,21 @@ func (p *Proxy) handle(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (p *Proxy) logError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	if isTimeout(err) {
+		status = http.StatusGatewayTimeout
+	}
+
 	p.logger.Log(logging.Entry{
 		Severity: logging.Error,
 		Payload:  err.Error(),
+		Labels:   logLabels(r),
 		HTTPRequest: &logging.HTTPRequest{
 			Request:  r,
-			Status:   http.StatusBadGateway,
-			RemoteIP: r.Header.Get("X-Forwarded-For"),
+			Status:   status,
+			RemoteIP: ClientIP(r),
 		},
 	})
 
-	w.WriteHeader(http.StatusBadGateway)
+	w.WriteHeader(status)
 }
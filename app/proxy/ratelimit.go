@@ -1,16 +1,77 @@
 package proxy
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
-type rateLimit struct {
-	enabled  bool
-	limit    uint64
-	duration time.Duration
-}
+	"github.com/mpraski/api-gateway/app/ratelimit"
+)
+
+type (
+	rateLimit struct {
+		enabled  bool
+		limit    uint64
+		duration time.Duration
+		// key lists the values of the request the requests are counted for.
+		key       []keyPart
+		algorithm ratelimit.Algorithm
+		failure   ratelimit.Failure
+		timeout   time.Duration
+		legacy    bool
+	}
+
+	keyPart struct {
+		source keySource
+		name   string
+	}
 
-func (c *rateLimit) parse(r *configRoute) {
+	keySource int
+)
+
+const (
+	keyClientIP keySource = iota
+	keySubject
+	keyAPIKey
+	keyHeader
+	keyCookie
+	keyParam
+	keyRoute
+)
+
+var (
+	algorithms = map[string]ratelimit.Algorithm{
+		"slidingWindow": ratelimit.SlidingWindow,
+		"gcra":          ratelimit.GCRA,
+	}
+
+	failures = map[string]ratelimit.Failure{
+		"local":  ratelimit.FailLocal,
+		"open":   ratelimit.FailOpen,
+		"closed": ratelimit.FailClosed,
+	}
+
+	keySources = map[string]keySource{
+		"ip":      keyClientIP,
+		"subject": keySubject,
+		"apiKey":  keyAPIKey,
+		"header":  keyHeader,
+		"cookie":  keyCookie,
+		"param":   keyParam,
+		"route":   keyRoute,
+	}
+
+	keySourceStr = []string{"ip", "subject", "apiKey", "header", "cookie", "param", "route"}
+
+	defaultRateLimitKey = []keyPart{{source: keyClientIP}}
+)
+
+func (c *rateLimit) parse(r *configRoute) error {
 	if r.RateLimit == nil {
-		return
+		return nil
 	}
 
 	if r.RateLimit.Enabled != nil {
@@ -24,6 +85,78 @@ func (c *rateLimit) parse(r *configRoute) {
 	if r.RateLimit.Duration != nil {
 		c.duration = *r.RateLimit.Duration
 	}
+
+	if r.RateLimit.Key != nil {
+		k, err := parseRateLimitKey(*r.RateLimit.Key)
+		if err != nil {
+			return err
+		}
+
+		c.key = k
+	}
+
+	if r.RateLimit.Algorithm != nil {
+		a, ok := algorithms[*r.RateLimit.Algorithm]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrInvalidAlgorithm, *r.RateLimit.Algorithm)
+		}
+
+		c.algorithm = a
+	}
+
+	if r.RateLimit.OnFailure != nil {
+		f, ok := failures[*r.RateLimit.OnFailure]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrInvalidRateLimitFailure, *r.RateLimit.OnFailure)
+		}
+
+		c.failure = f
+	}
+
+	if r.RateLimit.Timeout != nil {
+		c.timeout = *r.RateLimit.Timeout
+	}
+
+	if r.RateLimit.LegacyHeaders != nil {
+		c.legacy = *r.RateLimit.LegacyHeaders
+	}
+
+	return nil
+}
+
+// compose returns the key the request is counted for. Values missing from
+// the request fall back to the client IP, so that e.g. anonymous requests
+// are not all counted together. Every value is labelled with its source,
+// so that a header can't pose as the client IP of another client.
+func (c *rateLimit) compose(r *http.Request, m *match) string {
+	var sb strings.Builder
+
+	key := c.key
+	if key == nil {
+		key = defaultRateLimitKey
+	}
+
+	for i, p := range key {
+		if i > 0 {
+			sb.WriteRune('|')
+		}
+
+		sb.WriteString(p.value(r, m))
+	}
+
+	return sb.String()
+}
+
+// identity reports whether the key depends on the authenticated client,
+// in which case the requests are counted after the authorization.
+func (c *rateLimit) identity() bool {
+	for _, p := range c.key {
+		if p.source == keySubject || p.source == keyAPIKey {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (c *rateLimit) validate() error {
@@ -39,5 +172,104 @@ func (c *rateLimit) validate() error {
 		return ErrInvalidRateLimitDuration
 	}
 
+	if c.timeout < 0 {
+		return ErrInvalidRateLimitTimeout
+	}
+
 	return nil
 }
+
+// apiKey reports whether the requests are counted per partner.
+func (c *rateLimit) apiKey() bool {
+	for _, k := range c.key {
+		if k.source == keyAPIKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// params lists the path parameters the key refers to.
+func (c *rateLimit) params() []string {
+	var p []string
+
+	for _, k := range c.key {
+		if k.source == keyParam {
+			p = append(p, k.name)
+		}
+	}
+
+	return p
+}
+
+func (p keyPart) value(r *http.Request, m *match) string {
+	var v string
+
+	switch p.source {
+	case keyClientIP:
+		break
+	case keySubject:
+		v = m.claims.String("sub")
+	case keyAPIKey:
+		// Partners are identified once authenticated
+		v = r.Header.Get(partnerIDHeader)
+	case keyHeader:
+		v = r.Header.Get(p.name)
+	case keyCookie:
+		if c, err := r.Cookie(p.name); err == nil && c.Value != "" {
+			v = digest(c.Value)
+		}
+	case keyParam:
+		v = m.params[p.name]
+	case keyRoute:
+		v = m.route.prefix
+	}
+
+	if v == "" {
+		return keySourceStr[keyClientIP] + "=" + ClientIP(r)
+	}
+
+	return keySourceStr[p.source] + "=" + v
+}
+
+func digest(v string) string {
+	s := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(s[:12])
+}
+
+func parseRateLimitKey(c []string) ([]keyPart, error) {
+	k := make([]keyPart, 0, len(c))
+
+	for _, s := range c {
+		src, name, named := strings.Cut(strings.TrimSpace(s), ":")
+
+		v, ok := keySources[src]
+		if !ok {
+			return nil, fmt.Errorf("%w: source of %q is unknown", ErrInvalidRateLimitKey, s)
+		}
+
+		switch v {
+		case keyHeader, keyCookie, keyParam:
+			if name = strings.TrimSpace(name); name == "" {
+				return nil, fmt.Errorf("%w: %q is missing a name", ErrInvalidRateLimitKey, s)
+			}
+		default:
+			if named {
+				return nil, fmt.Errorf("%w: %q does not take a name", ErrInvalidRateLimitKey, s)
+			}
+		}
+
+		if v == keyHeader {
+			name = http.CanonicalHeaderKey(name)
+		}
+
+		k = append(k, keyPart{source: v, name: name})
+	}
+
+	if len(k) == 0 {
+		return nil, fmt.Errorf("%w: no values", ErrInvalidRateLimitKey)
+	}
+
+	return k, nil
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpraski/api-gateway/app/jwt"
+	"github.com/mpraski/api-gateway/app/ratelimit"
+	"github.com/mpraski/api-gateway/app/secret"
+)
+
+func newTestRateLimiter(t *testing.T) ratelimit.HandleFunc {
+	t.Helper()
+
+	m := ratelimit.NewMemoryStrategy(time.Minute)
+
+	t.Cleanup(m.Close)
+
+	return ratelimit.NewHandler(m, nil, func(r *http.Request) (string, error) {
+		return ClientIP(r), nil
+	}, log.New(io.Discard, "", 0))
+}
+
+func TestRateLimitKey(t *testing.T) {
+	m := &match{
+		params: map[string]string{"tenant": "acme"},
+		route:  &route{prefix: "/t/{tenant}"},
+		claims: jwt.Claims{"sub": "user-1"},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		key     []string
+		headers map[string]string
+		want    string
+		err     string
+	}{
+		{name: "default", want: "ip=192.0.2.1"},
+		{name: "subject", key: []string{"subject"}, want: "subject=user-1"},
+		{name: "partner", key: []string{"apiKey"}, headers: map[string]string{partnerIDHeader: "partner-1"}, want: "apiKey=partner-1"},
+		{name: "header", key: []string{"header:x-tenant"}, headers: map[string]string{"X-Tenant": "globex"}, want: "header=globex"},
+		{name: "cookie", key: []string{"cookie:sid"}, headers: map[string]string{"Cookie": "sid=secret"}, want: "cookie=" + digest("secret")},
+		{name: "param and route", key: []string{"param:tenant", "route"}, want: "param=acme|route=/t/{tenant}"},
+		{name: "missing values", key: []string{"ip", "header:x-tenant", "cookie:sid"}, want: "ip=192.0.2.1|ip=192.0.2.1|ip=192.0.2.1"},
+		{name: "unknown source", key: []string{"query:id"}, err: "source of"},
+		{name: "missing name", key: []string{"header"}, err: "missing a name"},
+		{name: "unexpected name", key: []string{"ip:x"}, err: "does not take a name"},
+		{name: "empty", key: []string{}, err: "no values"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c rateLimit
+
+			if tc.key != nil {
+				k, err := parseRateLimitKey(tc.key)
+				if tc.err != "" {
+					if !errors.Is(err, ErrInvalidRateLimitKey) || !strings.Contains(err.Error(), tc.err) {
+						t.Fatalf("expected error containing %q, got %v", tc.err, err)
+					}
+
+					return
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				c.key = k
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/t/acme", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+
+			if got := c.compose(r, m); got != tc.want {
+				t.Fatalf("expected key %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRateLimitAPIKeyRequiresPartner(t *testing.T) {
+	for _, policy := range []string{"allowed", "custom"} {
+		t.Run(policy, func(t *testing.T) {
+			_, err := New(`
+routes:
+  - prefix: /api
+    target: http://localhost
+    authorization:
+      policy: `+policy+`
+      custom:
+        url: http://localhost/auth
+    rateLimit:
+      enabled: true
+      limit: 1
+      duration: 1m
+      key: [apiKey]
+`, nil, nil, newTestLogger(t), nil)
+			if !errors.Is(err, ErrAPIKeyWithoutPartner) {
+				t.Fatalf("expected %v, got %v", ErrAPIKeyWithoutPartner, err)
+			}
+		})
+	}
+}
+
+// TestRateLimitSpoofedAPIKeys checks that the requests of a partner share
+// one limit, whatever partner ID or client IP they claim.
+func TestRateLimitSpoofedAPIKeys(t *testing.T) {
+	t.Setenv("ACME_KEY", "acme-secret!")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, err := New(`
+routes:
+  - prefix: /partners
+    target: `+backend.URL+`
+    authorization:
+      policy: partner
+      partner:
+        scheme: apiKey
+        keys:
+          acme: ACME_KEY
+    rateLimit:
+      enabled: true
+      limit: 2
+      duration: 1m
+      key: [apiKey]
+`, nil, secret.NewEnvSource(), newTestLogger(t), newTestRateLimiter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		name    string
+		key     string
+		partner string
+		code    int
+	}{
+		{"first request", "acme-secret!", "", http.StatusOK},
+		{"forged partner id", "acme-secret!", "other", http.StatusOK},
+		{"limit is shared", "acme-secret!", "another", http.StatusTooManyRequests},
+		{"unknown key", "random", "", http.StatusUnauthorized},
+		{"another unknown key", "random-2", "acme", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/partners", nil)
+			r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i+1)
+			r.Header.Set(defaultAPIKeyHeader, tc.key)
+
+			if tc.partner != "" {
+				r.Header.Set(partnerIDHeader, tc.partner)
+			}
+
+			w := httptest.NewRecorder()
+			p.Handler().ServeHTTP(w, r)
+
+			if w.Code != tc.code {
+				t.Fatalf("expected status %d, got %d", tc.code, w.Code)
+			}
+		})
+	}
+}
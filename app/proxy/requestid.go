@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// requestID correlates the log entries of the gateway with the ones of
+	// the upstreams. Incoming IDs are accepted unless disabled, otherwise a
+	// new UUID or ULID is generated.
+	requestID struct {
+		header string
+		format idFormat
+		accept bool
+	}
+
+	idFormat int
+
+	requestIDKey struct{}
+)
+
+const (
+	formatUUID idFormat = iota
+	formatULID
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-Id"
+	maxRequestIDLength     = 128
+	requestIDLabel         = "request_id"
+	crockford              = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+var defaultRequestID = requestID{header: defaultRequestIDHeader, accept: true}
+
+// resolve returns the ID of the request, it also sets
+// the ID on the request which is forwarded upstream.
+func (i *requestID) resolve(r *http.Request) string {
+	id := r.Header.Get(i.header)
+
+	if !i.accept || !validRequestID(id) {
+		id = i.generate()
+		r.Header.Set(i.header, id)
+	}
+
+	return id
+}
+
+func (i *requestID) generate() string {
+	if i.format == formatULID {
+		return newULID(time.Now())
+	}
+
+	return uuid.NewString()
+}
+
+// validRequestID accepts IDs of printable ASCII characters, which are safe to log and forward.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newULID returns a lexicographically sortable identifier made
+// of a 48 bit timestamp followed by 80 random bits.
+func newULID(t time.Time) string {
+	var b [16]byte
+
+	binary.BigEndian.PutUint64(b[:8], uint64(t.UnixMilli())<<16)
+
+	if _, err := rand.Read(b[6:]); err != nil {
+		return uuid.NewString()
+	}
+
+	var (
+		hi = binary.BigEndian.Uint64(b[:8])
+		lo = binary.BigEndian.Uint64(b[8:])
+		s  [26]byte
+	)
+
+	// 128 bits are encoded as 26 characters of 5 bits, the first one holding 3 bits
+	for j := 25; j >= 0; j-- {
+		s[j] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(s[:])
+}
+
+func withRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+func requestIDOf(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logLabels attach the request ID to log entries.
+func logLabels(r *http.Request) map[string]string {
+	if id := requestIDOf(r); id != "" {
+		return map[string]string{requestIDLabel: id}
+	}
+
+	return nil
+}
+
+func parseRequestID(c *configRequestID) (requestID, error) {
+	i := defaultRequestID
+
+	if c == nil {
+		return i, nil
+	}
+
+	if c.Header != nil {
+		if i.header = http.CanonicalHeaderKey(strings.TrimSpace(*c.Header)); i.header == "" {
+			return i, ErrInvalidRequestID
+		}
+	}
+
+	if c.Format != nil {
+		switch *c.Format {
+		case "uuid":
+			i.format = formatUUID
+		case "ulid":
+			i.format = formatULID
+		default:
+			return i, fmt.Errorf("%w: format %q is not valid", ErrInvalidRequestID, *c.Format)
+		}
+	}
+
+	if c.Accept != nil {
+		i.accept = *c.Accept
+	}
+
+	return i, nil
+}
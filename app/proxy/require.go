@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mpraski/api-gateway/app/jwt"
+)
+
+type (
+	// requirement restricts a route to callers whose identity
+	// token or JWT carries the listed scopes, roles or claim values.
+	requirement struct {
+		match  requireMatch
+		scopes []string
+		roles  []string
+		claims map[string][]string
+	}
+
+	requireMatch int
+)
+
+const (
+	matchAll requireMatch = iota
+	matchAny
+)
+
+// check reports whether the claims satisfy the requirement,
+// and if not, the reason why.
+func (q *requirement) check(c jwt.Claims) (string, bool) {
+	var unmet []string
+
+	if len(q.scopes) > 0 {
+		unmet = append(unmet, q.unmet("scope", q.scopes, scopes(c))...)
+	}
+
+	if len(q.roles) > 0 {
+		unmet = append(unmet, q.unmet("role", q.roles, roles(c))...)
+	}
+
+	for name, values := range q.claims {
+		if !intersects(values, claimValues(c, name)) {
+			unmet = append(unmet, fmt.Sprintf("claim %s", name))
+		}
+	}
+
+	total := len(q.scopes) + len(q.roles) + len(q.claims)
+
+	if len(unmet) == 0 || (q.match == matchAny && len(unmet) < total) {
+		return "", true
+	}
+
+	return "missing " + strings.Join(unmet, ", "), false
+}
+
+func (q *requirement) unmet(kind string, want, have []string) []string {
+	var u []string
+
+	for _, w := range want {
+		if !contains(have, w) {
+			u = append(u, fmt.Sprintf("%s %s", kind, w))
+		}
+	}
+
+	return u
+}
+
+func (q *requirement) validate() error {
+	if len(q.scopes) == 0 && len(q.roles) == 0 && len(q.claims) == 0 {
+		return ErrEmptyRequire
+	}
+
+	return nil
+}
+
+// scopes reads the space delimited scope claim (RFC 8693),
+// falling back to the scp claim used by some providers.
+func scopes(c jwt.Claims) []string {
+	if s := c.String("scope"); s != "" {
+		return strings.Fields(s)
+	}
+
+	return c.Strings("scp")
+}
+
+func roles(c jwt.Claims) []string {
+	if r := c.Strings("roles"); len(r) > 0 {
+		return r
+	}
+
+	return c.Strings("role")
+}
+
+// claimValues returns the claim as strings, numbers and booleans
+// are formatted so that they can be matched against the configuration.
+func claimValues(c jwt.Claims, name string) []string {
+	switch v := c[name].(type) {
+	case bool, float64:
+		return []string{fmt.Sprint(v)}
+	}
+
+	return c.Strings(name)
+}
+
+func intersects(a, b []string) bool {
+	for i := range a {
+		if contains(b, a[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseRequire(c *configRequire) (*requirement, error) {
+	q := requirement{claims: c.Claims}
+
+	if c.Match != nil {
+		switch *c.Match {
+		case "all":
+			q.match = matchAll
+		case "any":
+			q.match = matchAny
+		default:
+			return nil, fmt.Errorf("match %q is not valid", *c.Match)
+		}
+	}
+
+	if c.Scopes != nil {
+		q.scopes = *c.Scopes
+	}
+
+	if c.Roles != nil {
+		q.roles = *c.Roles
+	}
+
+	return &q, nil
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/mpraski/api-gateway/app/jwt"
+)
+
+func TestRequire(t *testing.T) {
+	var (
+		every = requirement{
+			match:  matchAll,
+			scopes: []string{"orders:read", "orders:write"},
+			roles:  []string{"admin"},
+			claims: map[string][]string{"tenant": {"acme", "globex"}},
+		}
+		some = every
+	)
+
+	some.match = matchAny
+
+	for _, tc := range []struct {
+		name   string
+		q      requirement
+		claims jwt.Claims
+		ok     bool
+		reason string
+	}{
+		{
+			name: "all met",
+			q:    every,
+			claims: jwt.Claims{
+				"scope":  "orders:read orders:write",
+				"roles":  []interface{}{"admin"},
+				"tenant": "globex",
+			},
+			ok: true,
+		},
+		{
+			name: "all with a scope missing",
+			q:    every,
+			claims: jwt.Claims{
+				"scope":  "orders:read",
+				"roles":  []interface{}{"admin"},
+				"tenant": "acme",
+			},
+			reason: "missing scope orders:write",
+		},
+		{
+			name:   "all with nothing met",
+			q:      every,
+			claims: jwt.Claims{"tenant": "initech"},
+			reason: "missing scope orders:read, scope orders:write, role admin, claim tenant",
+		},
+		{
+			name:   "any with one scope",
+			q:      some,
+			claims: jwt.Claims{"scp": []interface{}{"orders:write"}},
+			ok:     true,
+		},
+		{
+			name:   "any with one role",
+			q:      some,
+			claims: jwt.Claims{"role": "admin"},
+			ok:     true,
+		},
+		{
+			name:   "any with one claim",
+			q:      some,
+			claims: jwt.Claims{"tenant": []interface{}{"initech", "acme"}},
+			ok:     true,
+		},
+		{
+			name:   "any with nothing met",
+			q:      some,
+			claims: jwt.Claims{"scope": "orders:delete"},
+			reason: "missing scope orders:read, scope orders:write, role admin, claim tenant",
+		},
+		{
+			name:   "numbers and booleans",
+			q:      requirement{claims: map[string][]string{"level": {"3"}, "verified": {"true"}}},
+			claims: jwt.Claims{"level": float64(3), "verified": true},
+			ok:     true,
+		},
+		{
+			name:   "no claims",
+			q:      every,
+			reason: "missing scope orders:read, scope orders:write, role admin, claim tenant",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reason, ok := tc.q.check(tc.claims)
+			if ok != tc.ok {
+				t.Fatalf("expected ok to be %t, got %t", tc.ok, ok)
+			}
+
+			if reason != tc.reason {
+				t.Fatalf("expected reason %q, got %q", tc.reason, reason)
+			}
+		})
+	}
+}
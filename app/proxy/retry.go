@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// retryPolicy retries failed upstream requests. Requests which may have
+	// reached the upstream are only retried if their method is idempotent,
+	// unless the policy allows otherwise.
+	retryPolicy struct {
+		attempts      int
+		perTryTimeout time.Duration
+		backoff       time.Duration
+		maxBackoff    time.Duration
+		on            retryConditions
+		nonIdempotent bool
+		maxBodySize   int64
+		budget        *retryBudget
+	}
+
+	retryConditions struct {
+		connectFailure bool
+		reset          bool
+		timeout        bool
+		statuses       []int
+	}
+
+	// retryBudget caps retries to a ratio of the requests in the current
+	// window, plus a minimum so that routes with little traffic can retry.
+	// It keeps a failing upstream from being flooded with retries.
+	retryBudget struct {
+		ratio float64
+		min   int
+
+		mu       sync.Mutex
+		window   time.Time
+		requests int
+		retries  int
+	}
+
+	// cancelBody releases the per try timeout once the response has been read.
+	cancelBody struct {
+		io.ReadCloser
+		cancel context.CancelFunc
+	}
+)
+
+const (
+	retryConnectFailure = "connectFailure"
+	retryReset          = "reset"
+	retryTimeout        = "timeout"
+	retryStatus         = "status"
+)
+
+const (
+	defaultRetryAttempts    = 2
+	defaultRetryBackoff     = 25 * time.Millisecond
+	defaultRetryMaxBackoff  = 250 * time.Millisecond
+	defaultRetryMaxBodySize = 64 * 1024
+	defaultRetryBudgetRatio = 0.2
+	defaultRetryBudgetMin   = 10
+	retryBudgetWindow       = 10 * time.Second
+	maxDrainSize            = 4 * 1024
+)
+
+var (
+	defaultRetryConditions = retryConditions{
+		connectFailure: true,
+		statuses: []int{
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+
+	idempotentMethods = []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodOptions,
+		http.MethodPut,
+		http.MethodDelete,
+		http.MethodTrace,
+	}
+)
+
+// prepare buffers the request body so that it can be replayed,
+// it reports false if the body is too large to be buffered.
+func (p *retryPolicy) prepare(r *http.Request) bool {
+	return buffer(r, p.maxBodySize)
+}
+
+// retryable reports whether the outcome of the attempt should be retried and why.
+func (p *retryPolicy) retryable(r *http.Request, res *http.Response, err error, timedOut bool) (string, bool) {
+	if r.Context().Err() != nil {
+		return "", false
+	}
+
+	if err != nil && isConnectFailure(err) {
+		// The request never reached the upstream, so it is safe to retry
+		return retryConnectFailure, p.on.connectFailure
+	}
+
+	if !p.nonIdempotent && !contains(idempotentMethods, r.Method) {
+		return "", false
+	}
+
+	switch {
+	case err != nil && timedOut:
+		return retryTimeout, p.on.timeout
+	case err != nil:
+		return retryReset, p.on.reset
+	}
+
+	for _, s := range p.on.statuses {
+		if res.StatusCode == s {
+			return retryStatus, true
+		}
+	}
+
+	return "", false
+}
+
+// wait sleeps before the given retry, using exponential backoff with full jitter.
+func (p *retryPolicy) wait(ctx context.Context, retry int) error {
+	d := p.backoff << (retry - 1)
+	if d > p.maxBackoff || d <= 0 {
+		d = p.maxBackoff
+	}
+
+	if d > 0 {
+		d = time.Duration(rand.Int63n(int64(d))) //nolint:gosec //not used for security
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (p *retryPolicy) validate() error {
+	if p.attempts < 1 || p.backoff < 0 || p.maxBackoff < p.backoff || p.perTryTimeout < 0 || p.maxBodySize < 0 {
+		return ErrInvalidRetries
+	}
+
+	if p.budget.ratio < 0 || p.budget.ratio > 1 || p.budget.min < 0 {
+		return ErrInvalidRetryBudget
+	}
+
+	return nil
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll()
+	b.requests++
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll()
+
+	if float64(b.retries) >= float64(b.min)+b.ratio*float64(b.requests) {
+		return false
+	}
+
+	b.retries++
+
+	return true
+}
+
+func (b *retryBudget) roll() {
+	if now := time.Now(); now.Sub(b.window) > retryBudgetWindow {
+		b.window, b.requests, b.retries = now, 0, 0
+	}
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func isConnectFailure(err error) bool {
+	var o *net.OpError
+	return errors.As(err, &o) && o.Op == "dial"
+}
+
+// discard drains a small part of the body so that the connection can be reused.
+func discard(res *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, maxDrainSize))
+	res.Body.Close()
+}
+
+func parseRetries(c *configRetries) (*retryPolicy, error) {
+	p := retryPolicy{
+		attempts:    defaultRetryAttempts,
+		backoff:     defaultRetryBackoff,
+		maxBackoff:  defaultRetryMaxBackoff,
+		on:          defaultRetryConditions,
+		maxBodySize: defaultRetryMaxBodySize,
+		budget:      &retryBudget{ratio: defaultRetryBudgetRatio, min: defaultRetryBudgetMin},
+	}
+
+	if c.Attempts != nil {
+		p.attempts = *c.Attempts
+	}
+
+	if c.PerTryTimeout != nil {
+		p.perTryTimeout = *c.PerTryTimeout
+	}
+
+	if c.Backoff != nil {
+		p.backoff = *c.Backoff
+	}
+
+	if c.MaxBackoff != nil {
+		p.maxBackoff = *c.MaxBackoff
+	}
+
+	if c.NonIdempotent != nil {
+		p.nonIdempotent = *c.NonIdempotent
+	}
+
+	if c.MaxBodySize != nil {
+		p.maxBodySize = *c.MaxBodySize
+	}
+
+	if c.RetryOn != nil {
+		p.on = retryConditions{}
+
+		for _, o := range *c.RetryOn {
+			switch o {
+			case retryConnectFailure:
+				p.on.connectFailure = true
+			case retryReset:
+				p.on.reset = true
+			case retryTimeout:
+				p.on.timeout = true
+			default:
+				s, err := strconv.Atoi(o)
+				if err != nil || s < http.StatusInternalServerError || s > 599 {
+					return nil, fmt.Errorf("retry on %q is not valid", o)
+				}
+
+				p.on.statuses = append(p.on.statuses, s)
+			}
+		}
+	}
+
+	if c.Budget != nil {
+		if c.Budget.Ratio != nil {
+			p.budget.ratio = *c.Budget.Ratio
+		}
+
+		if c.Budget.Min != nil {
+			p.budget.min = *c.Budget.Min
+		}
+	}
+
+	return &p, nil
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	var (
+		policy = retryPolicy{
+			on: retryConditions{
+				connectFailure: true,
+				reset:          true,
+				timeout:        true,
+				statuses:       []int{http.StatusServiceUnavailable},
+			},
+		}
+		nonIdempotent = policy
+		dial          = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+		reset         = &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+	)
+
+	nonIdempotent.nonIdempotent = true
+
+	for _, tc := range []struct {
+		name     string
+		policy   retryPolicy
+		method   string
+		status   int
+		err      error
+		timedOut bool
+		gone     bool
+		reason   string
+	}{
+		{name: "connect failure", policy: policy, method: http.MethodPost, err: dial, reason: retryConnectFailure},
+		{name: "reset", policy: policy, method: http.MethodGet, err: reset, reason: retryReset},
+		{name: "reset of post", policy: policy, method: http.MethodPost, err: reset},
+		{name: "reset of post allowed", policy: nonIdempotent, method: http.MethodPost, err: reset, reason: retryReset},
+		{name: "timeout", policy: policy, method: http.MethodPut, err: context.DeadlineExceeded, timedOut: true, reason: retryTimeout},
+		{name: "timeout of patch", policy: policy, method: http.MethodPatch, err: context.DeadlineExceeded, timedOut: true},
+		{name: "status", policy: policy, method: http.MethodDelete, status: http.StatusServiceUnavailable, reason: retryStatus},
+		{name: "other status", policy: policy, method: http.MethodGet, status: http.StatusInternalServerError},
+		{name: "status of post", policy: policy, method: http.MethodPost, status: http.StatusServiceUnavailable},
+		{name: "success", policy: policy, method: http.MethodGet, status: http.StatusOK},
+		{name: "client gone", policy: policy, method: http.MethodGet, err: dial, gone: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/", nil)
+
+			if tc.gone {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+
+				r = r.WithContext(ctx)
+			}
+
+			var res *http.Response
+			if tc.err == nil {
+				res = &http.Response{StatusCode: tc.status}
+			}
+
+			reason, ok := tc.policy.retryable(r, res, tc.err, tc.timedOut)
+			if ok != (tc.reason != "") {
+				t.Fatalf("expected retry to be %t, got %t", tc.reason != "", ok)
+			}
+
+			if reason != tc.reason && ok {
+				t.Fatalf("expected reason %s, got %s", tc.reason, reason)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := retryBudget{ratio: 0.5, min: 1}
+
+	for i, tc := range []struct {
+		requests int
+		retries  int
+		want     int
+	}{
+		// The minimum allows a retry without traffic
+		{requests: 0, retries: 2, want: 1},
+		// Half of the requests may be retried on top of it
+		{requests: 4, retries: 3, want: 2},
+		{requests: 2, retries: 2, want: 1},
+	} {
+		for j := 0; j < tc.requests; j++ {
+			b.deposit()
+		}
+
+		var got int
+
+		for j := 0; j < tc.retries; j++ {
+			if b.withdraw() {
+				got++
+			}
+		}
+
+		if got != tc.want {
+			t.Fatalf("round %d: expected %d retries, got %d", i, tc.want, got)
+		}
+	}
+}
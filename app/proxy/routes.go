@@ -3,46 +3,273 @@ package proxy
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
 	"time"
 
-	"github.com/dghubble/trie"
-	"gopkg.in/yaml.v2"
+	"cloud.google.com/go/logging"
+	"github.com/mpraski/api-gateway/app/jwt"
+	"github.com/mpraski/api-gateway/app/secret"
 )
 
 type (
-	routes struct{ t *trie.PathTrie }
+	routes struct{ t *tree }
+
+	// node holds the routes mapped to the same prefix,
+	// which are told apart by the methods they accept.
+	node struct{ routes []*route }
+
+	// resources are shared by all routes and outlive configuration reloads.
+	resources struct {
+		secrets secret.Source
+		keySets *keySets
+		checks  *http.Client
+		logger  *logging.Logger
+	}
 
 	route struct {
-		cors      cors
-		target    *url.URL
-		rateLimit rateLimit
-		authz     authorization
-		prefix    string
-		rewrite   string
+		cors            cors
+		target          *url.URL
+		split           *split
+		upstream        *upstream
+		retries         *retryPolicy
+		circuit         *circuitBreaker
+		mirror          *mirror
+		timeouts        timeouts
+		rateLimit       rateLimit
+		authz           authorization
+		rewrite         *rewriteRule
+		requestHeaders  headerRules
+		responseHeaders headerRules
+		security        securityHeaders
+		allowedIPs      ipRanges
+		forwarded       forwardedHeaders
+		// id tells apart the routes mapped to the same prefix
+		// on other hosts or for other methods, it labels their metrics.
+		id      string
+		prefix  string
+		params  []string
+		methods []string
 	}
 
+	// match is the result of routing a request, it also carries
+	// the state gathered while the request is being handled.
 	match struct {
 		path  string
-		route *route
+		query string
+		// prefix is the part of the request path matched by the route.
+		prefix string
+		params map[string]string
+		route  *route
+		target *url.URL
+		// targetName identifies the target in metrics.
+		targetName string
+		endpoint   *endpoint
+		claims     jwt.Claims
+		// breaker of the target and whether the request probes it.
+		breaker *breaker
+		probe   bool
+	}
+
+	config struct {
+		Welcome   *string          `yaml:"welcome"`
+		Routes    []configRoute    `yaml:"routes,flow"`
+		Hosts     []configHost     `yaml:"hosts,flow"`
+		Upstreams []configUpstream `yaml:"upstreams,flow"`
+		// TrustedProxies may set X-Forwarded-For, e.g. the load balancer.
+		TrustedProxies []string         `yaml:"trustedProxies,flow"`
+		RequestID      *configRequestID `yaml:"requestId"`
+	}
+
+	configRequestID struct {
+		Header *string `yaml:"header"`
+		Format *string `yaml:"format"`
+		Accept *bool   `yaml:"accept"`
+	}
+
+	configUpstream struct {
+		Name        string             `yaml:"name"`
+		Endpoints   []string           `yaml:"endpoints,flow"`
+		Algorithm   *string            `yaml:"algorithm"`
+		Hash        *configHash        `yaml:"hash"`
+		HealthCheck *configHealthCheck `yaml:"healthCheck"`
+		Ejection    *configEjection    `yaml:"ejection"`
+		Critical    *bool              `yaml:"critical"`
+	}
+
+	configHash struct {
+		Header   *string `yaml:"header"`
+		Cookie   *string `yaml:"cookie"`
+		Identity *bool   `yaml:"identity"`
+	}
+
+	configHealthCheck struct {
+		Path               *string        `yaml:"path"`
+		Interval           *time.Duration `yaml:"interval"`
+		Timeout            *time.Duration `yaml:"timeout"`
+		HealthyThreshold   *int           `yaml:"healthyThreshold"`
+		UnhealthyThreshold *int           `yaml:"unhealthyThreshold"`
+	}
+
+	configEjection struct {
+		MaxFailures *int           `yaml:"maxFailures"`
+		Duration    *time.Duration `yaml:"duration"`
+	}
+
+	configHost struct {
+		Host    string        `yaml:"host"`
+		Welcome *string       `yaml:"welcome"`
+		Routes  []configRoute `yaml:"routes,flow"`
 	}
 
 	configRoute struct {
-		Prefix        string               `yaml:"prefix"`
-		Target        *string              `yaml:"target"`
-		Rewrite       *string              `yaml:"rewrite"`
-		Authorization *configAuthorization `yaml:"authorization"`
-		RateLimit     *configRateLimit     `yaml:"rateLimit"`
-		Cors          *configCors          `yaml:"cors"`
-		Routes        []configRoute        `yaml:"routes,flow"`
+		Prefix           string                `yaml:"prefix"`
+		Target           *string               `yaml:"target"`
+		Targets          *[]configTarget       `yaml:"targets,flow"`
+		Sticky           *configSticky         `yaml:"sticky"`
+		Upstream         *string               `yaml:"upstream"`
+		Retries          *configRetries        `yaml:"retries"`
+		Timeouts         *configTimeouts       `yaml:"timeouts"`
+		Circuit          *configCircuitBreaker `yaml:"circuitBreaker"`
+		Mirror           *configMirror         `yaml:"mirror"`
+		Rewrite          *string               `yaml:"rewrite"`
+		Methods          *[]string             `yaml:"methods,flow"`
+		RequestHeaders   *configHeaders        `yaml:"requestHeaders"`
+		ResponseHeaders  *configHeaders        `yaml:"responseHeaders"`
+		SecurityHeaders  *configSecurity       `yaml:"securityHeaders"`
+		AllowedIPs       *[]string             `yaml:"allowedIPs,flow"`
+		ForwardedHeaders *configForwarded      `yaml:"forwardedHeaders"`
+		Authorization    *configAuthorization  `yaml:"authorization"`
+		RateLimit        *configRateLimit      `yaml:"rateLimit"`
+		Cors             *configCors           `yaml:"cors"`
+		Routes           []configRoute         `yaml:"routes,flow"`
+	}
+
+	configRetries struct {
+		Attempts      *int               `yaml:"attempts"`
+		PerTryTimeout *time.Duration     `yaml:"perTryTimeout"`
+		Backoff       *time.Duration     `yaml:"backoff"`
+		MaxBackoff    *time.Duration     `yaml:"maxBackoff"`
+		RetryOn       *[]string          `yaml:"retryOn,flow"`
+		NonIdempotent *bool              `yaml:"nonIdempotent"`
+		MaxBodySize   *int64             `yaml:"maxBodySize"`
+		Budget        *configRetryBudget `yaml:"budget"`
+	}
+
+	configForwarded struct {
+		Forwarded *bool `yaml:"forwarded"`
+		Proto     *bool `yaml:"proto"`
+		Host      *bool `yaml:"host"`
+		Port      *bool `yaml:"port"`
+		Prefix    *bool `yaml:"prefix"`
+		Trust     *bool `yaml:"trust"`
+	}
+
+	configSecurity struct {
+		Preset                  *string `yaml:"preset"`
+		StrictTransportSecurity *string `yaml:"strictTransportSecurity"`
+		ContentTypeOptions      *string `yaml:"contentTypeOptions"`
+		FrameOptions            *string `yaml:"frameOptions"`
+		ReferrerPolicy          *string `yaml:"referrerPolicy"`
+		ContentSecurityPolicy   *string `yaml:"contentSecurityPolicy"`
+		Overwrite               *bool   `yaml:"overwrite"`
+	}
+
+	configHeaders struct {
+		Add    map[string]string `yaml:"add"`
+		Set    map[string]string `yaml:"set"`
+		Remove []string          `yaml:"remove,flow"`
+	}
+
+	configMirror struct {
+		Target             string         `yaml:"target"`
+		Percentage         *float64       `yaml:"percentage"`
+		MaxBodySize        *int64         `yaml:"maxBodySize"`
+		Timeout            *time.Duration `yaml:"timeout"`
+		ForwardCredentials *bool          `yaml:"forwardCredentials"`
+	}
+
+	configCircuitBreaker struct {
+		ConsecutiveFailures *int            `yaml:"consecutiveFailures"`
+		ErrorRate           *float64        `yaml:"errorRate"`
+		MinRequests         *int            `yaml:"minRequests"`
+		Window              *time.Duration  `yaml:"window"`
+		OpenDuration        *time.Duration  `yaml:"openDuration"`
+		HalfOpenRequests    *int            `yaml:"halfOpenRequests"`
+		Fallback            *configFallback `yaml:"fallback"`
+	}
+
+	configFallback struct {
+		Status      *int    `yaml:"status"`
+		ContentType *string `yaml:"contentType"`
+		Body        *string `yaml:"body"`
+	}
+
+	configTimeouts struct {
+		Connect        *time.Duration `yaml:"connect"`
+		ResponseHeader *time.Duration `yaml:"responseHeader"`
+		Request        *time.Duration `yaml:"request"`
+		Idle           *time.Duration `yaml:"idle"`
+	}
+
+	configRetryBudget struct {
+		Ratio *float64 `yaml:"ratio"`
+		Min   *int     `yaml:"min"`
+	}
+
+	configTarget struct {
+		URL    string  `yaml:"url"`
+		Name   *string `yaml:"name"`
+		Weight *int    `yaml:"weight"`
+	}
+
+	configSticky struct {
+		By     *string        `yaml:"by"`
+		Cookie *string        `yaml:"cookie"`
+		TTL    *time.Duration `yaml:"ttl"`
 	}
 
 	configAuthorization struct {
-		Via    *string `yaml:"via"`
-		From   *string `yaml:"from"`
-		Policy *string `yaml:"policy"`
+		Via     *string        `yaml:"via"`
+		From    *string        `yaml:"from"`
+		Policy  *string        `yaml:"policy"`
+		Partner *configPartner `yaml:"partner"`
+		Custom  *configCustom  `yaml:"custom"`
+		JWT     *configJWT     `yaml:"jwt"`
+		Require *configRequire `yaml:"require"`
+	}
+
+	configRequire struct {
+		Match  *string             `yaml:"match"`
+		Scopes *[]string           `yaml:"scopes,flow"`
+		Roles  *[]string           `yaml:"roles,flow"`
+		Claims map[string][]string `yaml:"claims"`
+	}
+
+	configJWT struct {
+		JWKS         *string        `yaml:"jwks"`
+		Issuers      *[]string      `yaml:"issuers,flow"`
+		Audiences    *[]string      `yaml:"audiences,flow"`
+		Algorithms   *[]string      `yaml:"algorithms,flow"`
+		Leeway       *time.Duration `yaml:"leeway"`
+		ClaimsHeader *string        `yaml:"claimsHeader"`
+	}
+
+	configPartner struct {
+		Scheme      *string           `yaml:"scheme"`
+		Header      *string           `yaml:"header"`
+		Keys        map[string]string `yaml:"keys"`
+		MaxSkew     *time.Duration    `yaml:"maxSkew"`
+		MaxBodySize *int64            `yaml:"maxBodySize"`
+	}
+
+	configCustom struct {
+		URL             *string        `yaml:"url"`
+		Timeout         *time.Duration `yaml:"timeout"`
+		RequestHeaders  *[]string      `yaml:"requestHeaders,flow"`
+		ResponseHeaders *[]string      `yaml:"responseHeaders,flow"`
 	}
 
 	configCors struct {
@@ -56,42 +283,82 @@ type (
 	}
 
 	configRateLimit struct {
-		Enabled  *bool          `yaml:"enabled"`
-		Limit    *uint64        `yaml:"limit"`
-		Duration *time.Duration `yaml:"duration"`
+		Enabled       *bool          `yaml:"enabled"`
+		Limit         *uint64        `yaml:"limit"`
+		Duration      *time.Duration `yaml:"duration"`
+		Key           *[]string      `yaml:"key,flow"`
+		Algorithm     *string        `yaml:"algorithm"`
+		OnFailure     *string        `yaml:"onFailure"`
+		Timeout       *time.Duration `yaml:"timeout"`
+		LegacyHeaders *bool          `yaml:"legacyHeaders"`
 	}
 )
 
 var (
 	ErrInvalidRateLimit         = errors.New("invalid rate limit")
 	ErrInvalidRateLimitDuration = errors.New("invalid rate limit duration")
+	ErrInvalidAlgorithm         = errors.New("invalid rate limit algorithm")
+	ErrInvalidRateLimitKey      = errors.New("invalid rate limit key")
+	ErrInvalidRateLimitFailure  = errors.New("invalid rate limit failure mode")
+	ErrInvalidRateLimitTimeout  = errors.New("invalid rate limit timeout")
 	ErrNoAllowedHeaders         = errors.New("no headers allowed in CORS")
 	ErrNoAllowedOrigins         = errors.New("no origins allowed in CORS")
 	ErrNoAllowedMethods         = errors.New("no methods allowed in CORS")
 	ErrNilPolicy                = errors.New("authorization policy cannot be nil")
 	ErrNilFrom                  = errors.New("authorization from cannot be nil when policy is permitted or enforced")
 	ErrNilVia                   = errors.New("authorization via cannot be nil when policy is permitted or enforced")
+	ErrNilPartner               = errors.New("authorization partner cannot be nil when policy is partner")
+	ErrNilPartnerScheme         = errors.New("partner scheme cannot be nil")
+	ErrNoPartnerKeys            = errors.New("no partner keys configured")
+	ErrNoSecretSource           = errors.New("no secret source configured")
+	ErrNilCustom                = errors.New("authorization custom cannot be nil when policy is custom")
+	ErrNilCustomURL             = errors.New("custom authorization url cannot be nil")
+	ErrNilJWT                   = errors.New("authorization jwt cannot be nil when via is jwt")
+	ErrNilJWKS                  = errors.New("jwt jwks cannot be nil")
+	ErrEmptyRequire             = errors.New("authorization require must list scopes, roles or claims")
+	ErrRequireWithoutIdentity   = errors.New("authorization require is only allowed when policy is permitted or enforced")
+	ErrNoMethods                = errors.New("no methods listed for route")
+	ErrNilHost                  = errors.New("host cannot be empty")
+	ErrInvalidHost              = errors.New("host is not valid")
+	ErrDuplicateHost            = errors.New("host is already configured")
+	ErrInvalidWelcome           = errors.New("welcome message must be valid JSON")
+	ErrUnknownKeyParam          = errors.New("rate limit key parameter is not defined by the prefix")
+	ErrAPIKeyWithoutPartner     = errors.New("rate limit key apiKey is only allowed when policy is partner")
+	ErrTargetAndTargets         = errors.New("route cannot have both target and targets")
+	ErrNoTargets                = errors.New("no targets listed for route")
+	ErrInvalidWeight            = errors.New("target weight cannot be negative")
+	ErrZeroWeights              = errors.New("at least one target must have a positive weight")
+	ErrDuplicateTarget          = errors.New("target name is already used")
+	ErrStickyWithoutTargets     = errors.New("sticky is only allowed with targets")
+	ErrTargetAndUpstream        = errors.New("route cannot have both a target and an upstream")
+	ErrUnknownUpstream          = errors.New("upstream is not defined")
+	ErrNilUpstreamName          = errors.New("upstream name cannot be empty")
+	ErrDuplicateUpstream        = errors.New("upstream is already defined")
+	ErrNoEndpoints              = errors.New("no endpoints listed for upstream")
+	ErrNilHash                  = errors.New("upstream hash cannot be nil when algorithm is hash")
+	ErrInvalidHealthCheck       = errors.New("invalid upstream health check")
+	ErrInvalidEjection          = errors.New("invalid upstream ejection")
+	ErrInvalidRetries           = errors.New("invalid retries")
+	ErrInvalidRetryBudget       = errors.New("invalid retry budget")
+	ErrInvalidTimeouts          = errors.New("invalid timeouts")
+	ErrInvalidCircuitBreaker    = errors.New("invalid circuit breaker")
+	ErrNilMirrorTarget          = errors.New("mirror target is nil")
+	ErrInvalidMirror            = errors.New("invalid mirror")
+	ErrInvalidRequestID         = errors.New("invalid request id")
 )
 
-func parseRoutes(configData string) (*routes, error) {
-	var c struct {
-		Routes []configRoute `yaml:"routes,flow"`
-	}
-
-	if err := yaml.NewDecoder(strings.NewReader(configData)).Decode(&c); err != nil {
-		return nil, fmt.Errorf("failed to decode config data: %w", err)
-	}
-
-	pathTrie := trie.NewPathTrie()
+// parseRoutes parses the routes of the host, empty for the default routes.
+func parseRoutes(h string, r []configRoute, res *resources, ups upstreams) (*routes, error) {
+	t := newTree()
 
-	if err := addRoutes(pathTrie, "/", nil, c.Routes); err != nil {
+	if err := addRoutes(t, res, ups, h, "/", nil, r); err != nil {
 		return nil, fmt.Errorf("failed to add routes: %w", err)
 	}
 
-	return &routes{t: pathTrie}, nil
+	return &routes{t: t}, nil
 }
 
-func addRoutes(t *trie.PathTrie, p string, a *route, r []configRoute) error {
+func addRoutes(t *tree, res *resources, ups upstreams, h, p string, a *route, r []configRoute) error {
 	if r == nil {
 		return nil
 	}
@@ -103,6 +370,11 @@ func addRoutes(t *trie.PathTrie, p string, a *route, r []configRoute) error {
 
 		m := path.Join(p, r[i].Prefix)
 
+		ps, err := paramNames(m)
+		if err != nil {
+			return fmt.Errorf("failed to parse prefix %q: %w", m, err)
+		}
+
 		var (
 			u *url.URL
 			e error
@@ -115,12 +387,82 @@ func addRoutes(t *trie.PathTrie, p string, a *route, r []configRoute) error {
 			}
 		}
 
-		var re string
+		sp, err := parseSplit(&r[i])
+		if err != nil {
+			return fmt.Errorf("failed to parse targets: %w", err)
+		}
+
+		var up *upstream
+		if r[i].Upstream != nil {
+			if u != nil || sp != nil {
+				return ErrTargetAndUpstream
+			}
+
+			if up = ups[*r[i].Upstream]; up == nil {
+				return fmt.Errorf("%w: %s", ErrUnknownUpstream, *r[i].Upstream)
+			}
+		}
+
+		var re *rewriteRule
 		if r[i].Rewrite != nil {
-			re = *r[i].Rewrite
+			if re, e = parseRewrite(*r[i].Rewrite, ps); e != nil {
+				return fmt.Errorf("failed to parse rewrite: %w", e)
+			}
+		}
+
+		var rq, rs headerRules
+		if a != nil {
+			rq, rs = a.requestHeaders.inherit(), a.responseHeaders.inherit()
 		}
 
-		authz, err := parseAuthorization(&r[i])
+		if e = rq.parse(r[i].RequestHeaders, ps); e != nil {
+			return fmt.Errorf("failed to parse request headers: %w", e)
+		}
+
+		if e = rs.parse(r[i].ResponseHeaders, ps); e != nil {
+			return fmt.Errorf("failed to parse response headers: %w", e)
+		}
+
+		var ms []string
+		if r[i].Methods != nil {
+			if ms, e = parseMethods(*r[i].Methods); e != nil {
+				return fmt.Errorf("failed to parse methods: %w", e)
+			}
+		} else if a != nil {
+			ms = a.methods
+		}
+
+		var rp *retryPolicy
+		if r[i].Retries != nil {
+			if rp, err = parseRetries(r[i].Retries); err != nil {
+				return fmt.Errorf("failed to parse retries: %w", err)
+			}
+		}
+
+		var cb *circuitBreaker
+		if r[i].Circuit != nil {
+			if cb, err = parseCircuitBreaker(r[i].Circuit, routeID(h, m, ms), res.logger); err != nil {
+				return fmt.Errorf("failed to parse circuit breaker: %w", err)
+			}
+		}
+
+		var ips ipRanges
+		if r[i].AllowedIPs != nil {
+			if ips, err = parseIPRanges(*r[i].AllowedIPs); err != nil {
+				return fmt.Errorf("failed to parse allowed IPs: %w", err)
+			}
+		} else if a != nil {
+			ips = a.allowedIPs
+		}
+
+		var mr *mirror
+		if r[i].Mirror != nil {
+			if mr, err = parseMirror(r[i].Mirror); err != nil {
+				return fmt.Errorf("failed to parse mirror: %w", err)
+			}
+		}
+
+		authz, err := parseAuthorization(&r[i], res)
 		if err != nil {
 			return fmt.Errorf("failed to parse authorization: %w", err)
 		}
@@ -130,7 +472,32 @@ func addRoutes(t *trie.PathTrie, p string, a *route, r []configRoute) error {
 			l = a.rateLimit
 		}
 
-		l.parse(&r[i])
+		if err := l.parse(&r[i]); err != nil {
+			return fmt.Errorf("failed to parse rate limit: %w", err)
+		}
+
+		to := defaultTimeouts
+		if a != nil {
+			to = a.timeouts
+		}
+
+		to.parse(&r[i])
+
+		fw := defaultForwardedHeaders
+		if a != nil {
+			fw = a.forwarded
+		}
+
+		fw.parse(&r[i])
+
+		var sh securityHeaders
+		if a != nil {
+			sh = a.security
+		}
+
+		if err := sh.parse(&r[i]); err != nil {
+			return fmt.Errorf("failed to parse security headers: %w", err)
+		}
 
 		var o cors
 		if a != nil {
@@ -142,20 +509,50 @@ func addRoutes(t *trie.PathTrie, p string, a *route, r []configRoute) error {
 		}
 
 		c := route{
-			cors:      o,
-			target:    u,
-			rewrite:   re,
-			rateLimit: l,
-			prefix:    r[i].Prefix,
-			authz:     authz,
+			cors:            o,
+			target:          u,
+			split:           sp,
+			upstream:        up,
+			retries:         rp,
+			circuit:         cb,
+			mirror:          mr,
+			timeouts:        to,
+			rewrite:         re,
+			rateLimit:       l,
+			requestHeaders:  rq,
+			responseHeaders: rs,
+			security:        sh,
+			allowedIPs:      ips,
+			forwarded:       fw,
+			id:              routeID(h, m, ms),
+			prefix:          m,
+			params:          ps,
+			methods:         ms,
+			authz:           authz,
+		}
+
+		if c.split != nil {
+			c.split.nameCookie(c.id)
 		}
 
 		if a != nil {
-			if c.target == nil && a.target != nil {
-				c.target = a.target
+			if c.target == nil && c.split == nil && c.upstream == nil {
+				c.target, c.split, c.upstream = a.target, a.split, a.upstream
+			}
+
+			if c.retries == nil && a.retries != nil {
+				c.retries = a.retries
 			}
 
-			if c.rewrite == "" && a.rewrite != "" {
+			if c.circuit == nil && a.circuit != nil {
+				c.circuit = a.circuit
+			}
+
+			if c.mirror == nil && a.mirror != nil {
+				c.mirror = a.mirror
+			}
+
+			if c.rewrite == nil && a.rewrite != nil {
 				c.rewrite = a.rewrite
 			}
 
@@ -170,17 +567,40 @@ func addRoutes(t *trie.PathTrie, p string, a *route, r []configRoute) error {
 			if c.authz.policy == nullPolicy && a.authz.policy != nullPolicy {
 				c.authz.policy = a.authz.policy
 			}
+
+			if c.authz.partner == nil && a.authz.partner != nil {
+				c.authz.partner = a.authz.partner
+			}
+
+			if c.authz.custom == nil && a.authz.custom != nil {
+				c.authz.custom = a.authz.custom
+			}
+
+			if c.authz.jwt == nil && a.authz.jwt != nil {
+				c.authz.jwt = a.authz.jwt
+			}
+
+			// Requirements only apply to routes which identify the caller,
+			// so that e.g. a public child of an admin route stays public
+			if c.authz.require == nil && a.authz.require != nil && c.authz.identifies() {
+				c.authz.require = a.authz.require
+			}
 		}
 
 		if err := c.validate(); err != nil {
 			return fmt.Errorf("route %q to %q is invalid: %w", c.prefix, c.target, err)
 		}
 
-		if !t.Put(m, &c) {
-			return fmt.Errorf("route %q to %q is already mapped", c.prefix, c.target)
+		ok, err := t.put(m, &c)
+		if err != nil {
+			return fmt.Errorf("failed to put route %q: %w", c.prefix, err)
 		}
 
-		if err := addRoutes(t, m, &c, r[i].Routes); err != nil {
+		if !ok {
+			return fmt.Errorf("route %q %s to %q is already mapped", c.prefix, c.methods, c.target)
+		}
+
+		if err := addRoutes(t, res, ups, h, m, &c, r[i].Routes); err != nil {
 			return err
 		}
 	}
@@ -203,33 +623,137 @@ func (r *route) validate() error {
 		return fmt.Errorf("rate limiter configuration invalid: %w", err)
 	}
 
+	if err = r.timeouts.validate(); err != nil {
+		return fmt.Errorf("timeouts configuration invalid: %w", err)
+	}
+
+	if r.retries != nil {
+		if err = r.retries.validate(); err != nil {
+			return fmt.Errorf("retries configuration invalid: %w", err)
+		}
+	}
+
+	for _, k := range r.rateLimit.params() {
+		if !contains(r.params, k) {
+			return fmt.Errorf("%w: %s", ErrUnknownKeyParam, k)
+		}
+	}
+
+	// Any other client could send a new key with every request
+	if r.rateLimit.enabled && r.rateLimit.apiKey() && r.authz.policy != partner {
+		return ErrAPIKeyWithoutPartner
+	}
+
 	return nil
 }
 
-func (r *routes) match(p string) (match, bool) {
-	var (
-		l int
-		t *route
-		e = r.t.WalkPath(p, func(key string, value interface{}) error {
-			//nolint:errcheck //always known
-			t = value.(*route)
-			l = len(key)
-
-			return nil
-		})
-	)
+// match finds the deepest route accepting the method. If the path is mapped
+// but none of its routes accept the method, the allowed methods are returned.
+func (r *routes) match(method, p string) (*match, []string, bool) {
+	l := lookup{method: method, path: p}
+
+	res, ok := r.t.find(&l, 0)
+	if !ok || (res.route.target == nil && res.route.split == nil && res.route.upstream == nil) {
+		return nil, l.allow, false
+	}
+
+	m := &match{path: p, prefix: p[:res.length], params: res.params, route: res.route}
+
+	if t := res.route.target; t != nil {
+		m.target, m.targetName = t, t.Host
+	}
+
+	if u := res.route.upstream; u != nil {
+		m.targetName = u.name
+	}
+
+	if m.route.rewrite != nil {
+		m.path, m.query = m.route.rewrite.apply(m.params, p[res.length:])
+	}
+
+	return m, nil, true
+}
+
+// find prefers routes listing the method over the ones accepting any method.
+func (n *node) find(method string) *route {
+	var fallback *route
+
+	for _, r := range n.routes {
+		switch {
+		case len(r.methods) == 0:
+			fallback = r
+		case r.accepts(method):
+			return r
+		}
+	}
+
+	return fallback
+}
+
+func (n *node) allowed() []string {
+	var a []string
+
+	for _, r := range n.routes {
+		for _, m := range r.methods {
+			if !contains(a, m) {
+				a = append(a, m)
+			}
+		}
+
+		if contains(r.methods, http.MethodGet) && !contains(a, http.MethodHead) {
+			a = append(a, http.MethodHead)
+		}
+	}
+
+	return a
+}
 
-	if e != nil || t == nil || t.target == nil {
-		return match{}, false
+// accepts reports whether the route accepts the method, GET implies HEAD.
+func (r *route) accepts(method string) bool {
+	if len(r.methods) == 0 || contains(r.methods, method) {
+		return true
 	}
 
-	m := match{path: p, route: t}
+	return method == http.MethodHead && contains(r.methods, http.MethodGet)
+}
+
+func (r *route) overlaps(o *route) bool {
+	if len(r.methods) == 0 || len(o.methods) == 0 {
+		return len(r.methods) == len(o.methods)
+	}
+
+	return intersects(r.methods, o.methods)
+}
+
+func parseMethods(methods []string) ([]string, error) {
+	if len(methods) == 0 {
+		return nil, ErrNoMethods
+	}
+
+	ms := make([]string, 0, len(methods))
+
+	for _, m := range methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" || strings.ContainsAny(m, " \t/") {
+			return nil, fmt.Errorf("method %q is not valid", m)
+		}
+
+		if !contains(ms, m) {
+			ms = append(ms, m)
+		}
+	}
+
+	return ms, nil
+}
 
-	if m.route.rewrite != "" {
-		m.path = singleJoiningSlash(m.route.rewrite, p[l:])
+// routeID is the host, the prefix and the methods of the route, e.g.
+// "api.my.domain/reports GET,POST", routes accepting any method have none.
+func routeID(host, prefix string, methods []string) string {
+	if len(methods) == 0 {
+		return host + prefix
 	}
 
-	return m, true
+	return host + prefix + " " + strings.Join(methods, ",")
 }
 
 func singleJoiningSlash(a, b string) string {
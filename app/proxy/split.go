@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type (
+	// split distributes the requests of a route between weighted targets,
+	// e.g. to send a small share of the traffic to a canary release.
+	split struct {
+		targets []weightedTarget
+		total   int
+		sticky  stickiness
+		cookie  string
+		ttl     time.Duration
+	}
+
+	weightedTarget struct {
+		url    *url.URL
+		name   string
+		weight int
+	}
+
+	stickiness int
+)
+
+const (
+	nullSticky stickiness = iota
+	stickyCookie
+	stickyIdentity
+)
+
+const (
+	defaultStickyCookie = "gateway-target"
+	defaultStickyTTL    = 24 * time.Hour
+)
+
+// pick chooses the target of the request. Sticky assignment keeps a user
+// on the same target, requests which cannot be assigned are distributed
+// by weight.
+func (s *split) pick(w http.ResponseWriter, r *http.Request, m *match) *weightedTarget {
+	switch s.sticky {
+	case stickyCookie:
+		if c, err := r.Cookie(s.cookie); err == nil {
+			if t := s.byName(c.Value); t != nil {
+				return t
+			}
+		}
+
+		t := s.byWeight(rand.Intn(s.total)) //nolint:gosec //not used for security
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.cookie,
+			Value:    t.name,
+			Path:     "/",
+			MaxAge:   int(s.ttl.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		return t
+
+	case stickyIdentity:
+		if sub := m.claims.String("sub"); sub != "" {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(sub))
+
+			return s.byWeight(int(h.Sum32() % uint32(s.total)))
+		}
+
+	case nullSticky:
+		break
+	}
+
+	return s.byWeight(rand.Intn(s.total)) //nolint:gosec //not used for security
+}
+
+// nameCookie names the cookie after the route unless configured, so that
+// the assignments of routes splitting between other targets are kept apart.
+func (s *split) nameCookie(routeID string) {
+	if s.cookie != "" {
+		return
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(routeID))
+
+	s.cookie = defaultStickyCookie + "-" + strconv.FormatUint(uint64(h.Sum32()), 36)
+}
+
+func (s *split) byWeight(n int) *weightedTarget {
+	for i := range s.targets {
+		if n < s.targets[i].weight {
+			return &s.targets[i]
+		}
+
+		n -= s.targets[i].weight
+	}
+
+	return &s.targets[len(s.targets)-1]
+}
+
+// byName ignores targets which have been drained by setting their weight to 0.
+func (s *split) byName(name string) *weightedTarget {
+	for i := range s.targets {
+		if s.targets[i].name == name && s.targets[i].weight > 0 {
+			return &s.targets[i]
+		}
+	}
+
+	return nil
+}
+
+func parseSplit(r *configRoute) (*split, error) {
+	if r.Targets == nil {
+		if r.Sticky != nil {
+			return nil, ErrStickyWithoutTargets
+		}
+
+		return nil, nil
+	}
+
+	if r.Target != nil {
+		return nil, ErrTargetAndTargets
+	}
+
+	if len(*r.Targets) == 0 {
+		return nil, ErrNoTargets
+	}
+
+	s := split{ttl: defaultStickyTTL}
+
+	for _, c := range *r.Targets {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse target: %w", err)
+		}
+
+		t := weightedTarget{url: u, name: u.Host, weight: 1}
+
+		if c.Name != nil {
+			t.name = *c.Name
+		}
+
+		if c.Weight != nil {
+			t.weight = *c.Weight
+		}
+
+		if t.weight < 0 {
+			return nil, ErrInvalidWeight
+		}
+
+		for i := range s.targets {
+			if s.targets[i].name == t.name {
+				return nil, fmt.Errorf("%w: %s", ErrDuplicateTarget, t.name)
+			}
+		}
+
+		s.targets = append(s.targets, t)
+		s.total += t.weight
+	}
+
+	if s.total == 0 {
+		return nil, ErrZeroWeights
+	}
+
+	if c := r.Sticky; c != nil {
+		s.sticky = stickyCookie
+
+		if c.By != nil {
+			switch *c.By {
+			case "cookie":
+				s.sticky = stickyCookie
+			case "identity":
+				s.sticky = stickyIdentity
+			default:
+				return nil, fmt.Errorf("sticky by %q is not valid", *c.By)
+			}
+		}
+
+		if c.Cookie != nil {
+			s.cookie = *c.Cookie
+		}
+
+		if c.TTL != nil {
+			s.ttl = *c.TTL
+		}
+	}
+
+	return &s, nil
+}
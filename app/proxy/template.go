@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type (
+	// template is a string with {name} placeholders, which are replaced
+	// with the path parameters of the request, or the variables of headers.
+	template []templatePart
+
+	templatePart struct {
+		literal string
+		param   string
+	}
+
+	// rewriteRule replaces the matched prefix with path and,
+	// if it contains a query, adds it to the upstream request.
+	rewriteRule struct {
+		path  template
+		query template
+	}
+)
+
+func parseTemplate(s string, params []string) (template, error) {
+	var t template
+
+	for s != "" {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			t = append(t, templatePart{literal: s})
+			break
+		}
+
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("placeholder in %q is not closed", s)
+		}
+
+		name := s[i+1 : i+j]
+		if !contains(params, name) {
+			return nil, fmt.Errorf("parameter %q is not defined by the prefix", name)
+		}
+
+		if i > 0 {
+			t = append(t, templatePart{literal: s[:i]})
+		}
+
+		t = append(t, templatePart{param: name})
+		s = s[i+j+1:]
+	}
+
+	return t, nil
+}
+
+func (t template) expand(params map[string]string, escape func(string) string) string {
+	var sb strings.Builder
+
+	for _, p := range t {
+		if p.param == "" {
+			sb.WriteString(p.literal)
+		} else {
+			sb.WriteString(escape(params[p.param]))
+		}
+	}
+
+	return sb.String()
+}
+
+func parseRewrite(s string, params []string) (*rewriteRule, error) {
+	var (
+		r       rewriteRule
+		err     error
+		p, q, _ = strings.Cut(s, "?")
+	)
+
+	if r.path, err = parseTemplate(p, params); err != nil {
+		return nil, err
+	}
+
+	if r.query, err = parseTemplate(q, params); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// apply returns the upstream path and the query to add to the request.
+func (r *rewriteRule) apply(params map[string]string, rest string) (string, string) {
+	return singleJoiningSlash(r.path.expand(params, noEscape), rest),
+		r.query.expand(params, url.QueryEscape)
+}
+
+// noEscape keeps path parameters decoded, the path is escaped once the request
+// is sent and parameters are single segments, which are never dot segments.
+func noEscape(s string) string { return s }
+
+// headerEscape drops control characters, which are not allowed in header values.
+func headerEscape(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < ' ' && r != '\t') || r == 0x7f {
+			return -1
+		}
+
+		return r
+	}, s)
+}
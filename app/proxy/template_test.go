@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewriteParams(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.EscapedPath()))
+	}))
+	defer backend.Close()
+
+	p, err := New(`
+routes:
+  - prefix: /users/{id}
+    target: `+backend.URL+`
+    rewrite: /v1/users/{id}/profile
+    authorization:
+      policy: allowed
+`, nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		path string
+		code int
+		want string
+	}{
+		{"plain", "/users/42", http.StatusOK, "/v1/users/42/profile"},
+		{"escaped", "/users/a%20b", http.StatusOK, "/v1/users/a%20b/profile"},
+		{"rest", "/users/42/x", http.StatusOK, "/v1/users/42/profile/x"},
+		{"dot", "/users/.", http.StatusNotFound, ""},
+		{"dot dot", "/users/..", http.StatusNotFound, ""},
+		{"escaped dot dot", "/users/%2E%2E", http.StatusNotFound, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != tc.code {
+				t.Fatalf("expected status %d, got %d", tc.code, w.Code)
+			}
+
+			if tc.want != "" && w.Body.String() != tc.want {
+				t.Fatalf("expected path %s, got %s", tc.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestParseRewrite(t *testing.T) {
+	params := map[string]string{"id": "42", "q": "a b&c=d"}
+
+	for _, tc := range []struct {
+		rewrite string
+		rest    string
+		path    string
+		query   string
+		err     string
+	}{
+		{rewrite: "/v1/users/{id}", rest: "/orders", path: "/v1/users/42/orders"},
+		{rewrite: "/v1/users/{id}/", rest: "/orders", path: "/v1/users/42/orders"},
+		{rewrite: "/", path: "/"},
+		{rewrite: "/search?q={q}&user={id}", path: "/search", query: "q=a+b%26c%3Dd&user=42"},
+		{rewrite: "/v1/{name}", err: `parameter "name" is not defined`},
+		{rewrite: "/v1/{id", err: "is not closed"},
+		{rewrite: "/v1?user={name}", err: `parameter "name" is not defined`},
+	} {
+		t.Run(tc.rewrite, func(t *testing.T) {
+			r, err := parseRewrite(tc.rewrite, []string{"id", "q"})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path, query := r.apply(params, tc.rest)
+
+			if path != tc.path {
+				t.Fatalf("expected path %s, got %s", tc.path, path)
+			}
+
+			if query != tc.query {
+				t.Fatalf("expected query %s, got %s", tc.query, query)
+			}
+		})
+	}
+}
+
+func TestHeaderEscape(t *testing.T) {
+	if got := headerEscape("a\r\nX-Injected: 1\tb\x7f"); got != "aX-Injected: 1\tb" {
+		t.Fatalf("expected control characters to be dropped, got %q", got)
+	}
+}
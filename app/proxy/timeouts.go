@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// timeouts bound the upstream request of a route. The connect and response
+	// header timeouts apply to every attempt, the request timeout to the whole
+	// exchange including the response body and the idle timeout to the gaps
+	// between reads of a streamed response.
+	timeouts struct {
+		connect        time.Duration
+		responseHeader time.Duration
+		request        time.Duration
+		idle           time.Duration
+	}
+
+	// idleBody cancels the upstream request when no data has been read for the timeout.
+	idleBody struct {
+		io.ReadCloser
+		timeout time.Duration
+		timer   *time.Timer
+	}
+
+	// attemptContext cancels an attempt which has no response within the timeout.
+	// Unlike a context deadline it is stopped once the response headers arrive,
+	// the body is then left to the request and idle timeouts.
+	attemptContext struct {
+		context.Context
+		timer   *time.Timer
+		expired atomic.Bool
+	}
+
+	connectTimeoutKey struct{}
+)
+
+var (
+	defaultTimeouts = timeouts{
+		connect:        DefaultDialTimeout,
+		responseHeader: DefaultResponseHeaderTimeout,
+	}
+
+	errUpstreamTimeout = errors.New("upstream timed out")
+)
+
+func (t *timeouts) parse(r *configRoute) {
+	if r.Timeouts == nil {
+		return
+	}
+
+	if r.Timeouts.Connect != nil {
+		t.connect = *r.Timeouts.Connect
+	}
+
+	if r.Timeouts.ResponseHeader != nil {
+		t.responseHeader = *r.Timeouts.ResponseHeader
+	}
+
+	if r.Timeouts.Request != nil {
+		t.request = *r.Timeouts.Request
+	}
+
+	if r.Timeouts.Idle != nil {
+		t.idle = *r.Timeouts.Idle
+	}
+}
+
+func (t *timeouts) validate() error {
+	if t.connect < 0 || t.responseHeader < 0 || t.request < 0 || t.idle < 0 {
+		return ErrInvalidTimeouts
+	}
+
+	return nil
+}
+
+// context returns the context of the upstream request,
+// bounded by the request timeout if there is one.
+func (t *timeouts) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, connectTimeoutKey{}, t.connect)
+
+	if t.request > 0 {
+		return context.WithTimeout(ctx, t.request)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// extend lifts the write timeout of the server for routes which bound
+// the response themselves, so that long responses and streams are not cut off.
+func (t *timeouts) extend(w http.ResponseWriter) {
+	c := http.NewResponseController(w)
+
+	switch {
+	case t.request > 0:
+		_ = c.SetWriteDeadline(time.Now().Add(t.request + time.Second))
+	case t.idle > 0:
+		_ = c.SetWriteDeadline(time.Time{})
+	}
+}
+
+// watch cancels the upstream request if the response body stalls.
+func (t *timeouts) watch(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	if t.idle <= 0 {
+		return body
+	}
+
+	return &idleBody{ReadCloser: body, timeout: t.idle, timer: time.AfterFunc(t.idle, cancel)}
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// withAttemptTimeout returns the context of an attempt bounded by the timeout.
+func withAttemptTimeout(parent context.Context, d time.Duration) (*attemptContext, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	c := &attemptContext{Context: ctx}
+
+	c.timer = time.AfterFunc(d, func() {
+		c.expired.Store(true)
+		cancel(context.DeadlineExceeded)
+	})
+
+	return c, func() {
+		c.timer.Stop()
+		cancel(nil)
+	}
+}
+
+// stop lifts the timeout once the response headers have arrived.
+func (c *attemptContext) stop() {
+	c.timer.Stop()
+}
+
+// Err reports the expired timeout as a deadline like its cause does, so that
+// the transport fails the attempt with context.DeadlineExceeded.
+func (c *attemptContext) Err() error {
+	err := c.Context.Err()
+	if err == nil || !c.expired.Load() {
+		return err
+	}
+
+	return context.DeadlineExceeded
+}
+
+// dialContext dials with the connect timeout of the route the request belongs to.
+func dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	t, ok := ctx.Value(connectTimeoutKey{}).(time.Duration)
+	if !ok || t <= 0 {
+		t = DefaultDialTimeout
+	}
+
+	d := net.Dialer{Timeout: t, KeepAlive: DefaultKeepalive}
+
+	return d.DialContext(ctx, network, address)
+}
+
+func isTimeout(err error) bool {
+	var n net.Error
+
+	return errors.Is(err, errUpstreamTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &n) && n.Timeout()
+}
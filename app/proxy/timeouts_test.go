@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAttemptContext(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		run  func(*attemptContext, context.CancelFunc, context.CancelFunc)
+		want error
+	}{
+		{
+			name: "expired",
+			run: func(c *attemptContext, _, _ context.CancelFunc) {
+				<-c.Done()
+			},
+			want: context.DeadlineExceeded,
+		},
+		{
+			name: "stopped",
+			run: func(c *attemptContext, _, _ context.CancelFunc) {
+				c.stop()
+				time.Sleep(20 * time.Millisecond)
+			},
+		},
+		{
+			name: "cancelled",
+			run: func(c *attemptContext, cancel, _ context.CancelFunc) {
+				cancel()
+			},
+			want: context.Canceled,
+		},
+		{
+			name: "parent cancelled",
+			run: func(c *attemptContext, _, cancelParent context.CancelFunc) {
+				cancelParent()
+				<-c.Done()
+			},
+			want: context.Canceled,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parent, cancelParent := context.WithCancel(context.Background())
+			defer cancelParent()
+
+			c, cancel := withAttemptTimeout(parent, 10*time.Millisecond)
+			defer cancel()
+
+			tc.run(c, cancel, cancelParent)
+
+			if err := c.Err(); !errors.Is(err, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+// TestUpstreamTimeout checks that only the upstreams which don't answer
+// in time are reported as timeouts.
+func TestUpstreamTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/reset":
+			c, _, _ := http.NewResponseController(w).Hijack()
+			c.Close()
+		}
+	}))
+	defer backend.Close()
+
+	p, err := New(`
+routes:
+  - prefix: /
+    target: `+backend.URL+`
+    authorization:
+      policy: allowed
+    timeouts:
+      responseHeader: 50ms
+`, nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/fast", http.StatusOK},
+		{"/slow", http.StatusGatewayTimeout},
+		{"/reset", http.StatusBadGateway},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != tc.code {
+				t.Fatalf("expected status %d, got %d", tc.code, w.Code)
+			}
+		})
+	}
+}
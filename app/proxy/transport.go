@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"crypto/tls"
-	"net"
 	"net/http"
 	"time"
 )
@@ -19,18 +18,14 @@ const (
 )
 
 func newTransport() *http.Transport {
+	// Dial and response header timeouts are set per route
 	t := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   DefaultDialTimeout,
-			KeepAlive: DefaultKeepalive,
-			DualStack: true,
-		}).DialContext,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialContext,
 		MaxIdleConns:          DefaultMaxIdleConns,
 		IdleConnTimeout:       DefaultIdleConnTimeout,
 		TLSHandshakeTimeout:   DefaultTLSHandshakeTimeout,
 		ExpectContinueTimeout: DefaultExpectContinueTimeout,
-		ResponseHeaderTimeout: DefaultResponseHeaderTimeout,
 		MaxIdleConnsPerHost:   DefaultIdleConnsPerHost,
 		//nolint:gosec //not relevant
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
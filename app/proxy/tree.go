@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type (
+	// tree maps route prefixes to nodes segment by segment. A segment is
+	// either literal or a parameter written as {name} or {name:regexp},
+	// which captures the whole path segment.
+	tree struct {
+		node     *node
+		literals map[string]*tree
+		params   []*paramTree
+	}
+
+	paramTree struct {
+		tree
+		segment segment
+	}
+
+	segment struct {
+		raw  string
+		name string
+		re   *regexp.Regexp
+	}
+
+	// lookup holds the state of a single search through the tree.
+	lookup struct {
+		method string
+		path   string
+		params []string
+		// allow lists the methods of the deepest node matching
+		// the path if none of its routes accepts the method.
+		allow []string
+	}
+
+	result struct {
+		route  *route
+		params map[string]string
+		length int
+	}
+)
+
+var paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func newTree() *tree { return &tree{} }
+
+// put adds the route under the prefix, failing if
+// a route accepting the same methods is already there.
+func (t *tree) put(prefix string, r *route) (bool, error) {
+	segs, err := parseSegments(prefix)
+	if err != nil {
+		return false, err
+	}
+
+	n := t
+
+	for _, s := range segs {
+		n = n.child(s)
+	}
+
+	if n.node == nil {
+		n.node = &node{}
+	}
+
+	for _, o := range n.node.routes {
+		if o.overlaps(r) {
+			return false, nil
+		}
+	}
+
+	n.node.routes = append(n.node.routes, r)
+
+	return true, nil
+}
+
+// walk calls f with every route in the tree.
+func (t *tree) walk(f func(*route)) {
+	if t.node != nil {
+		for _, r := range t.node.routes {
+			f(r)
+		}
+	}
+
+	for _, c := range t.literals {
+		c.walk(f)
+	}
+
+	for _, c := range t.params {
+		c.walk(f)
+	}
+}
+
+func (t *tree) child(s segment) *tree {
+	if s.name == "" {
+		if t.literals == nil {
+			t.literals = make(map[string]*tree)
+		}
+
+		c, ok := t.literals[s.raw]
+		if !ok {
+			c = &tree{}
+			t.literals[s.raw] = c
+		}
+
+		return c
+	}
+
+	for _, p := range t.params {
+		if p.segment.raw == s.raw {
+			return &p.tree
+		}
+	}
+
+	p := &paramTree{segment: s}
+
+	// Constrained parameters are tried before unconstrained ones
+	i := len(t.params)
+	if s.re != nil {
+		for i = 0; i < len(t.params) && t.params[i].segment.re != nil; i++ {
+		}
+	}
+
+	t.params = append(t.params, nil)
+	copy(t.params[i+1:], t.params[i:])
+	t.params[i] = p
+
+	return &p.tree
+}
+
+// find returns the deepest route accepting the method. Literal segments
+// take precedence over parameters, and a branch which does not lead to
+// a route is abandoned in favour of the next one. The search ends at the
+// deepest node with routes, if none of them accepts the method, the less
+// specific routes of the ancestors are not tried.
+func (t *tree) find(l *lookup, i int) (result, bool) {
+	if i < len(l.path) && l.path[i] == '/' {
+		end := len(l.path)
+		if j := strings.IndexByte(l.path[i+1:], '/'); j >= 0 {
+			end = i + 1 + j
+		}
+
+		s := l.path[i+1 : end]
+
+		if c, ok := t.literals[s]; ok {
+			if r, ok := c.find(l, end); ok || l.allow != nil {
+				return r, ok
+			}
+		}
+
+		// Dot segments are never parameters, rewritten they
+		// would move the request up the path of the upstream
+		if s != "" && s != "." && s != ".." {
+			for _, p := range t.params {
+				if p.segment.re != nil && !p.segment.re.MatchString(s) {
+					continue
+				}
+
+				l.params = append(l.params, p.segment.name, s)
+
+				if r, ok := p.find(l, end); ok || l.allow != nil {
+					return r, ok
+				}
+
+				l.params = l.params[:len(l.params)-2]
+			}
+		}
+	}
+
+	if t.node == nil {
+		return result{}, false
+	}
+
+	if r := t.node.find(l.method); r != nil {
+		return result{route: r, params: l.captured(), length: i}, true
+	}
+
+	l.allow = t.node.allowed()
+
+	return result{}, false
+}
+
+func (l *lookup) captured() map[string]string {
+	if len(l.params) == 0 {
+		return nil
+	}
+
+	p := make(map[string]string, len(l.params)/2)
+
+	for i := 0; i < len(l.params); i += 2 {
+		p[l.params[i]] = l.params[i+1]
+	}
+
+	return p
+}
+
+func parseSegments(prefix string) ([]segment, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return nil, nil
+	}
+
+	var (
+		raw   = strings.Split(prefix, "/")
+		segs  = make([]segment, 0, len(raw))
+		names = make(map[string]bool)
+	)
+
+	for _, r := range raw {
+		s, err := parseSegment(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.name != "" {
+			if names[s.name] {
+				return nil, fmt.Errorf("parameter %q is used more than once", s.name)
+			}
+
+			names[s.name] = true
+		}
+
+		segs = append(segs, s)
+	}
+
+	return segs, nil
+}
+
+func parseSegment(r string) (segment, error) {
+	if !strings.HasPrefix(r, "{") || !strings.HasSuffix(r, "}") {
+		if strings.ContainsAny(r, "{}") {
+			return segment{}, fmt.Errorf("segment %q must be either literal or a parameter", r)
+		}
+
+		return segment{raw: r}, nil
+	}
+
+	s := segment{raw: r, name: r[1 : len(r)-1]}
+
+	if i := strings.IndexByte(s.name, ':'); i >= 0 {
+		re, err := regexp.Compile("^(?:" + s.name[i+1:] + ")$")
+		if err != nil {
+			return segment{}, fmt.Errorf("failed to compile parameter %q: %w", r, err)
+		}
+
+		s.name, s.re = s.name[:i], re
+	}
+
+	if !paramName.MatchString(s.name) {
+		return segment{}, fmt.Errorf("parameter name %q is not valid", s.name)
+	}
+
+	return s, nil
+}
+
+// paramNames returns the names of the parameters of the prefix.
+func paramNames(prefix string) ([]string, error) {
+	segs, err := parseSegments(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var n []string
+
+	for _, s := range segs {
+		if s.name != "" {
+			n = append(n, s.name)
+		}
+	}
+
+	return n, nil
+}
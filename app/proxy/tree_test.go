@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTreeFind(t *testing.T) {
+	tr := newTree()
+
+	for _, r := range []*route{
+		{prefix: "/"},
+		{prefix: "/users"},
+		{prefix: "/users/me", methods: []string{http.MethodGet}},
+		{prefix: "/users/{id:[0-9]+}", methods: []string{http.MethodGet}},
+		{prefix: "/users/{name}"},
+		{prefix: "/users/{id:[0-9]+}/orders", methods: []string{http.MethodGet, http.MethodPost}},
+		{prefix: "/users/{id:[0-9]+}/orders", methods: []string{http.MethodDelete}},
+	} {
+		if ok, err := tr.put(r.prefix, r); err != nil || !ok {
+			t.Fatalf("failed to put %s: %v", r.prefix, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		prefix string
+		params map[string]string
+		length int
+		allow  string
+	}{
+		{method: http.MethodGet, path: "/", prefix: "/", length: 0},
+		{method: http.MethodGet, path: "/other/path", prefix: "/", length: 0},
+		{method: http.MethodGet, path: "/users", prefix: "/users", length: 6},
+		{method: http.MethodGet, path: "/users/me", prefix: "/users/me", length: 9},
+		{method: http.MethodHead, path: "/users/me", prefix: "/users/me", length: 9},
+		{method: http.MethodPost, path: "/users/me", allow: "GET,HEAD"},
+		{method: http.MethodGet, path: "/users/42", prefix: "/users/{id:[0-9]+}", params: map[string]string{"id": "42"}, length: 9},
+		{method: http.MethodDelete, path: "/users/42", allow: "GET,HEAD"},
+		{method: http.MethodDelete, path: "/users/bob", prefix: "/users/{name}", params: map[string]string{"name": "bob"}, length: 10},
+		{method: http.MethodGet, path: "/users/bob/orders", prefix: "/users/{name}", params: map[string]string{"name": "bob"}, length: 10},
+		{method: http.MethodPost, path: "/users/42/orders/7", prefix: "/users/{id:[0-9]+}/orders", params: map[string]string{"id": "42"}, length: 16},
+		{method: http.MethodDelete, path: "/users/42/orders", prefix: "/users/{id:[0-9]+}/orders", params: map[string]string{"id": "42"}, length: 16},
+		{method: http.MethodPut, path: "/users/42/orders", allow: "GET,POST,HEAD,DELETE"},
+		{method: http.MethodGet, path: "/users/..", prefix: "/users", length: 6},
+		{method: http.MethodGet, path: "/users//x", prefix: "/users", length: 6},
+	} {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			l := lookup{method: tc.method, path: tc.path}
+
+			res, ok := tr.find(&l, 0)
+
+			if tc.allow != "" {
+				if ok {
+					t.Fatalf("expected no route, got %s", res.route.prefix)
+				}
+
+				if got := strings.Join(l.allow, ","); got != tc.allow {
+					t.Fatalf("expected allow %s, got %s", tc.allow, got)
+				}
+
+				return
+			}
+
+			if !ok {
+				t.Fatalf("expected route %s, got none", tc.prefix)
+			}
+
+			if res.route.prefix != tc.prefix {
+				t.Fatalf("expected route %s, got %s", tc.prefix, res.route.prefix)
+			}
+
+			if !reflect.DeepEqual(res.params, tc.params) {
+				t.Fatalf("expected params %v, got %v", tc.params, res.params)
+			}
+
+			if res.length != tc.length {
+				t.Fatalf("expected length %d, got %d", tc.length, res.length)
+			}
+		})
+	}
+}
+
+func TestTreePut(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		prefix string
+		method string
+		ok     bool
+		err    string
+	}{
+		{name: "other methods", prefix: "/a", method: http.MethodPost, ok: true},
+		{name: "same methods", prefix: "/a/", method: http.MethodGet},
+		{name: "other parameter", prefix: "/b/{other}", method: http.MethodGet, ok: true},
+		{name: "mixed segment", prefix: "/c/x{id}", err: "must be either literal or a parameter"},
+		{name: "invalid name", prefix: "/c/{1d}", err: "is not valid"},
+		{name: "invalid regexp", prefix: "/c/{id:[}", err: "failed to compile"},
+		{name: "repeated parameter", prefix: "/c/{id}/{id}", err: "more than once"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := newTree()
+
+			for _, p := range []string{"/a", "/b/{id}"} {
+				if _, err := tr.put(p, &route{prefix: p, methods: []string{http.MethodGet}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ok, err := tr.put(tc.prefix, &route{prefix: tc.prefix, methods: []string{tc.method}})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok != tc.ok {
+				t.Fatalf("expected ok to be %t, got %t", tc.ok, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/logging"
+	"google.golang.org/api/option"
+)
+
+// newTestLogger writes the entries to nowhere instead of Cloud Logging.
+func newTestLogger(t *testing.T) *logging.Logger {
+	t.Helper()
+
+	c, err := logging.NewClient(context.Background(), "test", option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = c.Close() })
+
+	return c.Logger("test", logging.RedirectAsJSON(io.Discard))
+}
+
+// TestUpgrade checks that the upgraded connection is writable
+// after passing through the retries of the route.
+func TestUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		defer conn.Close()
+
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+
+		l, _ := brw.ReadString('\n')
+		_, _ = brw.WriteString(strings.ToUpper(l))
+		_ = brw.Flush()
+	}))
+	defer backend.Close()
+
+	p, err := New(`
+routes:
+  - prefix: /ws
+    target: `+backend.URL+`
+    authorization:
+      policy: allowed
+    retries:
+      attempts: 3
+    timeouts:
+      responseHeader: 1s
+`, nil, nil, newTestLogger(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := httptest.NewServer(p.Handler())
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	_, _ = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, got %d", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+
+	_, _ = io.WriteString(conn, "hello\n")
+
+	l, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l != "HELLO\n" {
+		t.Fatalf("expected echo of the upgraded connection, got %q", l)
+	}
+}
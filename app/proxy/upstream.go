@@ -0,0 +1,502 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mpraski/api-gateway/app/metrics"
+)
+
+type (
+	// upstream is a named pool of endpoints serving the same backend. Endpoints
+	// are taken out of rotation when they fail active health checks or, with
+	// ejection configured, after consecutive failed requests.
+	upstream struct {
+		name      string
+		endpoints []*endpoint
+		balancer  balancer
+		hashOn    hashSource
+		hashKey   string
+		check     *healthCheck
+		ejection  *ejection
+		critical  bool
+		client    *http.Client
+		next      uint32
+		done      chan struct{}
+	}
+
+	upstreams map[string]*upstream
+
+	endpoint struct {
+		url    *url.URL
+		active int64
+
+		mu        sync.Mutex
+		healthy   bool
+		successes int
+		failures  int
+		errors    int
+		ejected   time.Time
+	}
+
+	healthCheck struct {
+		path               string
+		interval           time.Duration
+		timeout            time.Duration
+		healthyThreshold   int
+		unhealthyThreshold int
+	}
+
+	ejection struct {
+		maxFailures int
+		duration    time.Duration
+	}
+
+	balancer int
+
+	hashSource int
+
+	// UpstreamStatus describes the health of an upstream pool.
+	UpstreamStatus struct {
+		Name      string           `json:"name"`
+		Critical  bool             `json:"critical"`
+		Healthy   int              `json:"healthy"`
+		Endpoints []EndpointStatus `json:"endpoints"`
+	}
+
+	EndpointStatus struct {
+		URL     string `json:"url"`
+		Healthy bool   `json:"healthy"`
+		Ejected bool   `json:"ejected"`
+		Active  int64  `json:"active"`
+	}
+)
+
+const (
+	roundRobin balancer = iota
+	leastRequests
+	consistentHash
+)
+
+const (
+	nullHash hashSource = iota
+	hashHeader
+	hashCookie
+	hashIdentity
+)
+
+const (
+	defaultHealthCheckPath     = "/"
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+	defaultEjectionFailures    = 5
+	defaultEjectionDuration    = 30 * time.Second
+)
+
+// pick returns the endpoint to send the request to,
+// or nil if none of the endpoints is available.
+func (u *upstream) pick(r *http.Request, m *match) *endpoint {
+	es := u.available()
+	if len(es) == 0 {
+		return nil
+	}
+
+	switch u.balancer {
+	case leastRequests:
+		// Start at a rotating offset, so that ties are spread across endpoints
+		var (
+			n    = int(atomic.AddUint32(&u.next, 1))
+			best = es[n%len(es)]
+		)
+
+		for i := 1; i < len(es); i++ {
+			if e := es[(n+i)%len(es)]; atomic.LoadInt64(&e.active) < atomic.LoadInt64(&best.active) {
+				best = e
+			}
+		}
+
+		return best
+
+	case consistentHash:
+		if k := u.key(r, m); k != "" {
+			return rendezvous(es, k)
+		}
+
+	case roundRobin:
+		break
+	}
+
+	return es[int(atomic.AddUint32(&u.next, 1))%len(es)]
+}
+
+func (u *upstream) key(r *http.Request, m *match) string {
+	switch u.hashOn {
+	case hashHeader:
+		return r.Header.Get(u.hashKey)
+	case hashCookie:
+		if c, err := r.Cookie(u.hashKey); err == nil {
+			return c.Value
+		}
+	case hashIdentity:
+		return m.claims.String("sub")
+	case nullHash:
+		break
+	}
+
+	return ""
+}
+
+// rendezvous hashing keeps most keys on the same endpoint
+// when endpoints leave or rejoin the rotation.
+func rendezvous(es []*endpoint, key string) *endpoint {
+	var (
+		best  *endpoint
+		score uint64
+	)
+
+	for _, e := range es {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte(e.url.String()))
+
+		if s := h.Sum64(); best == nil || s > score {
+			best, score = e, s
+		}
+	}
+
+	return best
+}
+
+func (u *upstream) available() []*endpoint {
+	var (
+		now = time.Now()
+		es  = make([]*endpoint, 0, len(u.endpoints))
+	)
+
+	for _, e := range u.endpoints {
+		e.mu.Lock()
+		ok := e.healthy && !now.Before(e.ejected)
+		e.mu.Unlock()
+
+		if ok {
+			es = append(es, e)
+		}
+	}
+
+	return es
+}
+
+// observe records the outcome of a request for passive health checking,
+// connection errors and gateway errors of the endpoint count as failures.
+func (u *upstream) observe(e *endpoint, status int, err error) {
+	if u.ejection == nil {
+		return
+	}
+
+	failed := err != nil ||
+		status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !failed {
+		e.errors = 0
+		return
+	}
+
+	if e.errors++; e.errors >= u.ejection.maxFailures {
+		e.errors = 0
+		e.ejected = time.Now().Add(u.ejection.duration)
+
+		metrics.UpstreamEjections.WithLabelValues(u.name).Inc()
+	}
+}
+
+func (e *endpoint) acquire() { atomic.AddInt64(&e.active, 1) }
+
+func (e *endpoint) release() { atomic.AddInt64(&e.active, -1) }
+
+// start begins active health checking, the pool is
+// started once its configuration has been applied.
+func (u *upstream) start() {
+	for _, e := range u.endpoints {
+		metrics.UpstreamHealthy.WithLabelValues(u.name, e.url.String()).Set(1)
+	}
+
+	if u.check == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(u.check.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-u.done:
+				return
+			case <-ticker.C:
+				u.probe()
+			}
+		}
+	}()
+}
+
+func (u *upstream) stop() {
+	close(u.done)
+
+	for _, e := range u.endpoints {
+		metrics.UpstreamHealthy.DeleteLabelValues(u.name, e.url.String())
+	}
+}
+
+func (u *upstream) probe() {
+	var wg sync.WaitGroup
+
+	for _, e := range u.endpoints {
+		wg.Add(1)
+
+		go func(e *endpoint) {
+			defer wg.Done()
+
+			ok := u.healthy(e)
+
+			e.mu.Lock()
+			defer e.mu.Unlock()
+
+			if ok {
+				e.successes, e.failures = e.successes+1, 0
+			} else {
+				e.successes, e.failures = 0, e.failures+1
+			}
+
+			switch {
+			case !e.healthy && e.successes >= u.check.healthyThreshold:
+				e.healthy = true
+			case e.healthy && e.failures >= u.check.unhealthyThreshold:
+				e.healthy = false
+			default:
+				return
+			}
+
+			v := 0.0
+			if e.healthy {
+				v = 1
+			}
+
+			metrics.UpstreamHealthy.WithLabelValues(u.name, e.url.String()).Set(v)
+		}(e)
+	}
+
+	wg.Wait()
+}
+
+func (u *upstream) healthy(e *endpoint) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), u.check.timeout)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, singleJoiningSlash(e.url.String(), u.check.path), http.NoBody)
+	if err != nil {
+		return false
+	}
+
+	s, err := u.client.Do(r)
+	if err != nil {
+		return false
+	}
+
+	s.Body.Close()
+
+	return s.StatusCode >= http.StatusOK && s.StatusCode < http.StatusBadRequest
+}
+
+func (u *upstream) status() UpstreamStatus {
+	var (
+		now = time.Now()
+		s   = UpstreamStatus{Name: u.name, Critical: u.critical}
+	)
+
+	for _, e := range u.endpoints {
+		e.mu.Lock()
+		es := EndpointStatus{
+			URL:     e.url.String(),
+			Healthy: e.healthy,
+			Ejected: now.Before(e.ejected),
+			Active:  atomic.LoadInt64(&e.active),
+		}
+		e.mu.Unlock()
+
+		if es.Healthy && !es.Ejected {
+			s.Healthy++
+		}
+
+		s.Endpoints = append(s.Endpoints, es)
+	}
+
+	return s
+}
+
+func (u upstreams) start() {
+	for _, p := range u {
+		p.start()
+	}
+}
+
+func (u upstreams) stop() {
+	for _, p := range u {
+		p.stop()
+	}
+}
+
+func (u upstreams) status() []UpstreamStatus {
+	s := make([]UpstreamStatus, 0, len(u))
+
+	for _, p := range u {
+		s = append(s, p.status())
+	}
+
+	sort.Slice(s, func(i, j int) bool { return s[i].Name < s[j].Name })
+
+	return s
+}
+
+func parseUpstreams(c []configUpstream, client *http.Client) (upstreams, error) {
+	u := make(upstreams, len(c))
+
+	for i := range c {
+		if c[i].Name == "" {
+			return nil, ErrNilUpstreamName
+		}
+
+		if _, ok := u[c[i].Name]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateUpstream, c[i].Name)
+		}
+
+		p, err := parseUpstream(&c[i], client)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q is invalid: %w", c[i].Name, err)
+		}
+
+		u[p.name] = p
+	}
+
+	return u, nil
+}
+
+func parseUpstream(c *configUpstream, client *http.Client) (*upstream, error) {
+	if len(c.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	u := upstream{name: c.Name, client: client, done: make(chan struct{})}
+
+	for _, s := range c.Endpoints {
+		e, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse endpoint: %w", err)
+		}
+
+		if e.Scheme != "http" && e.Scheme != "https" {
+			return nil, fmt.Errorf("endpoint %q must be absolute", s)
+		}
+
+		u.endpoints = append(u.endpoints, &endpoint{url: e, healthy: true})
+	}
+
+	if c.Algorithm != nil {
+		switch *c.Algorithm {
+		case "roundRobin":
+			u.balancer = roundRobin
+		case "leastRequests":
+			u.balancer = leastRequests
+		case "hash":
+			u.balancer = consistentHash
+		default:
+			return nil, fmt.Errorf("algorithm %q is not valid", *c.Algorithm)
+		}
+	}
+
+	if c.Hash != nil {
+		switch {
+		case c.Hash.Header != nil:
+			u.hashOn, u.hashKey = hashHeader, http.CanonicalHeaderKey(strings.TrimSpace(*c.Hash.Header))
+		case c.Hash.Cookie != nil:
+			u.hashOn, u.hashKey = hashCookie, *c.Hash.Cookie
+		case c.Hash.Identity != nil && *c.Hash.Identity:
+			u.hashOn = hashIdentity
+		}
+	}
+
+	if u.balancer == consistentHash && u.hashOn == nullHash {
+		return nil, ErrNilHash
+	}
+
+	if c.HealthCheck != nil {
+		u.check = &healthCheck{
+			path:               defaultHealthCheckPath,
+			interval:           defaultHealthCheckInterval,
+			timeout:            defaultHealthCheckTimeout,
+			healthyThreshold:   defaultHealthyThreshold,
+			unhealthyThreshold: defaultUnhealthyThreshold,
+		}
+
+		if c.HealthCheck.Path != nil {
+			u.check.path = *c.HealthCheck.Path
+		}
+
+		if c.HealthCheck.Interval != nil {
+			u.check.interval = *c.HealthCheck.Interval
+		}
+
+		if c.HealthCheck.Timeout != nil {
+			u.check.timeout = *c.HealthCheck.Timeout
+		}
+
+		if c.HealthCheck.HealthyThreshold != nil {
+			u.check.healthyThreshold = *c.HealthCheck.HealthyThreshold
+		}
+
+		if c.HealthCheck.UnhealthyThreshold != nil {
+			u.check.unhealthyThreshold = *c.HealthCheck.UnhealthyThreshold
+		}
+
+		if u.check.interval <= 0 || u.check.timeout <= 0 ||
+			u.check.healthyThreshold < 1 || u.check.unhealthyThreshold < 1 {
+			return nil, ErrInvalidHealthCheck
+		}
+	}
+
+	if c.Ejection != nil {
+		u.ejection = &ejection{maxFailures: defaultEjectionFailures, duration: defaultEjectionDuration}
+
+		if c.Ejection.MaxFailures != nil {
+			u.ejection.maxFailures = *c.Ejection.MaxFailures
+		}
+
+		if c.Ejection.Duration != nil {
+			u.ejection.duration = *c.Ejection.Duration
+		}
+
+		if u.ejection.maxFailures < 1 || u.ejection.duration <= 0 {
+			return nil, ErrInvalidEjection
+		}
+	}
+
+	if c.Critical != nil {
+		u.critical = *c.Critical
+	}
+
+	return &u, nil
+}
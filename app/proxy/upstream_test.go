@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestUpstream(t *testing.T, b balancer, hosts ...string) *upstream {
+	t.Helper()
+
+	u := upstream{name: "test", balancer: b, hashOn: hashHeader, hashKey: "X-User"}
+
+	for _, h := range hosts {
+		u.endpoints = append(u.endpoints, &endpoint{url: &url.URL{Scheme: "http", Host: h}, healthy: true})
+	}
+
+	return &u
+}
+
+func TestUpstreamPick(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		balancer balancer
+		prepare  func(*upstream)
+		users    []string
+		want     []string
+	}{
+		{
+			name:     "round robin",
+			balancer: roundRobin,
+			users:    []string{"", "", "", ""},
+			want:     []string{"b", "c", "a", "b"},
+		},
+		{
+			name:     "round robin skips unhealthy",
+			balancer: roundRobin,
+			prepare:  func(u *upstream) { u.endpoints[1].healthy = false },
+			users:    []string{"", "", ""},
+			want:     []string{"c", "a", "c"},
+		},
+		{
+			name:     "round robin skips ejected",
+			balancer: roundRobin,
+			prepare:  func(u *upstream) { u.endpoints[2].ejected = time.Now().Add(time.Minute) },
+			users:    []string{"", "", ""},
+			want:     []string{"b", "a", "b"},
+		},
+		{
+			name:     "least requests",
+			balancer: leastRequests,
+			prepare: func(u *upstream) {
+				u.endpoints[0].active, u.endpoints[1].active, u.endpoints[2].active = 3, 1, 2
+			},
+			users: []string{"", ""},
+			want:  []string{"b", "b"},
+		},
+		{
+			name:     "consistent hash without a key",
+			balancer: consistentHash,
+			users:    []string{"", ""},
+			want:     []string{"b", "c"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newTestUpstream(t, tc.balancer, "a", "b", "c")
+
+			if tc.prepare != nil {
+				tc.prepare(u)
+			}
+
+			for i, user := range tc.users {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				if user != "" {
+					r.Header.Set("X-User", user)
+				}
+
+				if e := u.pick(r, &match{}); e.url.Host != tc.want[i] {
+					t.Fatalf("request %d: expected endpoint %s, got %s", i, tc.want[i], e.url.Host)
+				}
+			}
+		})
+	}
+}
+
+// TestUpstreamConsistentHash checks that keys stay on their endpoint,
+// also when another endpoint leaves the rotation.
+func TestUpstreamConsistentHash(t *testing.T) {
+	u := newTestUpstream(t, consistentHash, "a", "b", "c", "d")
+
+	pick := func(user string) *endpoint {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", user)
+
+		return u.pick(r, &match{})
+	}
+
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"}
+	picked := make(map[string]*endpoint, len(users))
+
+	for _, user := range users {
+		picked[user] = pick(user)
+
+		if e := pick(user); e != picked[user] {
+			t.Fatalf("expected %s to stay on %s, got %s", user, picked[user].url.Host, e.url.Host)
+		}
+	}
+
+	gone := picked[users[0]]
+	gone.healthy = false
+
+	for _, user := range users {
+		e := pick(user)
+
+		switch {
+		case e == gone:
+			t.Fatalf("expected %s to leave %s", user, gone.url.Host)
+		case picked[user] != gone && e != picked[user]:
+			t.Fatalf("expected %s to stay on %s, got %s", user, picked[user].url.Host, e.url.Host)
+		}
+	}
+}
+
+func TestUpstreamPickNone(t *testing.T) {
+	u := newTestUpstream(t, roundRobin, "a")
+	u.endpoints[0].healthy = false
+
+	if e := u.pick(httptest.NewRequest(http.MethodGet, "/", nil), &match{}); e != nil {
+		t.Fatalf("expected no endpoint, got %s", e.url.Host)
+	}
+}
+
+func TestUpstreamEjection(t *testing.T) {
+	u := newTestUpstream(t, roundRobin, "a")
+	u.ejection = &ejection{maxFailures: 3, duration: time.Minute}
+
+	e := u.endpoints[0]
+
+	for i, tc := range []struct {
+		status  int
+		err     error
+		ejected bool
+	}{
+		{status: http.StatusBadGateway},
+		{err: errors.New("connection refused")},
+		{status: http.StatusOK},
+		{status: http.StatusInternalServerError},
+		{status: http.StatusServiceUnavailable},
+		{status: http.StatusGatewayTimeout},
+		{status: http.StatusBadGateway, ejected: true},
+	} {
+		u.observe(e, tc.status, tc.err)
+
+		if ejected := len(u.available()) == 0; ejected != tc.ejected {
+			t.Fatalf("outcome %d: expected ejected to be %t, got %t", i, tc.ejected, ejected)
+		}
+	}
+}
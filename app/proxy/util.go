@@ -1,7 +1,11 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/textproto"
 	"strings"
@@ -29,6 +33,14 @@ type (
 	switchProtocolCopier struct {
 		user, backend io.ReadWriter
 	}
+
+	// statusWriter records the status code written to the underlying
+	// http.ResponseWriter while preserving its flushing and hijacking
+	// capabilities.
+	statusWriter struct {
+		http.ResponseWriter
+		status int
+	}
 )
 
 const toLower = 'a' - 'A'
@@ -85,6 +97,16 @@ func parseHeaderList(headerList string) []string {
 	return headers
 }
 
+func contains(s []string, e string) bool {
+	for i := range s {
+		if s[i] == e {
+			return true
+		}
+	}
+
+	return false
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -126,6 +148,18 @@ func removeConnectionHeaders(h http.Header) {
 	}
 }
 
+// routingMethod returns the method a request is routed by, CORS preflight
+// requests are routed by the method of the request they precede.
+func routingMethod(r *http.Request) string {
+	if r.Method == http.MethodOptions {
+		if m := r.Header.Get("Access-Control-Request-Method"); m != "" {
+			return strings.ToUpper(m)
+		}
+	}
+
+	return r.Method
+}
+
 func upgradeType(h http.Header) string {
 	if !httpguts.HeaderValuesContainsToken(h["Connection"], "Upgrade") {
 		return ""
@@ -193,3 +227,78 @@ func (c switchProtocolCopier) copyToBackend(errc chan<- error) {
 	_, err := io.Copy(c.backend, c.user)
 	errc <- err
 }
+
+// buffer reads the request body into memory and sets GetBody, so that the
+// body can be sent more than once. It reports false if the body is larger
+// than the limit, leaving the body to be read once as it was.
+func buffer(r *http.Request, limit int64) bool {
+	if r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return true
+	}
+
+	if r.ContentLength > limit {
+		return false
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(b)) > limit {
+		// Pass on what has been read
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+		return false
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	return true
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter type %T is not a Hijacker", w.ResponseWriter)
+	}
+
+	c, b, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return c, b, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// GCRAStrategy implements the generic cell rate algorithm, which is
+// a token bucket refilled at a steady rate, allowing bursts of up to
+// the limit. It keeps a single timestamp per key, the theoretical
+// arrival time of the next request, updated atomically in a script.
+type GCRAStrategy struct {
+	client *redis.Client
+}
+
+const gcraPrefix = "gcra:"
+
+// gcraScript takes the emission interval and the period in microseconds.
+// It returns whether the request is allowed, the time until the bucket
+// is full again and the time until the next request is allowed.
+// The time of the server is used, so that gateway replicas agree. Scripts
+// calling TIME may only write when their effects are replicated instead of
+// the script, which is the default since Redis 5 and has to be turned on
+// before, so Redis 3.2 or later is required.
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local emission = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if tat == nil or tat < now then
+	tat = now
+end
+
+local next = tat + emission
+if next - period > now then
+	return {0, tat - now, next - period - now}
+end
+
+redis.call('SET', KEYS[1], string.format('%.0f', next), 'PX', math.ceil((next - now) / 1000))
+
+return {1, next - now, 0}
+`)
+
+var _ Strategy = (*GCRAStrategy)(nil)
+
+func NewGCRAStrategy(client *redis.Client) *GCRAStrategy {
+	return &GCRAStrategy{client: client}
+}
+
+// Run reports the number of requests in the bucket as the total requests,
+// which expire once the bucket is full again.
+func (s *GCRAStrategy) Run(ctx context.Context, r Request) (Result, error) {
+	var (
+		now      = time.Now().UTC()
+		period   = r.Duration.Microseconds()
+		emission = period / int64(r.Limit)
+		res      = Result{
+			State:     Deny,
+			ExpiresAt: now.Add(r.Duration),
+		}
+	)
+
+	if emission == 0 {
+		emission = 1
+	}
+
+	v, err := gcraScript.Run(ctx, s.client, []string{gcraPrefix + r.Key}, emission, period).Int64Slice()
+	if err != nil {
+		return res, fmt.Errorf("failed to run gcra script for key %q: %w", r.Key, err)
+	}
+
+	if len(v) != 3 {
+		return res, fmt.Errorf("failed to run gcra script for key %q: unexpected result %v", r.Key, v)
+	}
+
+	// Each request in the bucket delays the time it is full by the emission interval
+	res.TotalRequests = uint64((v[1] + emission - 1) / emission)
+
+	res.ExpiresAt = now.Add(time.Duration(v[1]) * time.Microsecond)
+
+	if v[0] == 0 {
+		res.RetryAt = now.Add(time.Duration(v[2]) * time.Microsecond)
+		return res, nil
+	}
+
+	res.State = Allow
+
+	return res, nil
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newGCRAStrategy(t *testing.T) (*GCRAStrategy, *miniredis.Miniredis, time.Time) {
+	t.Helper()
+
+	m, now := miniredis.RunT(t), time.Now()
+	// The script reads the time of the server, which stays put unless moved
+	m.SetTime(now)
+
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	t.Cleanup(func() { _ = c.Close() })
+
+	return NewGCRAStrategy(c), m, now
+}
+
+func TestGCRABurst(t *testing.T) {
+	s, _, _ := newGCRAStrategy(t)
+	r := Request{Key: "burst", Limit: 10, Duration: time.Second, Algorithm: GCRA}
+
+	for i := 1; i <= 10; i++ {
+		res, err := s.Run(context.Background(), r)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+
+		if res.State != Allow {
+			t.Fatalf("request %d: expected to be allowed", i)
+		}
+
+		if res.TotalRequests != uint64(i) {
+			t.Fatalf("request %d: expected %d total requests, got %d", i, i, res.TotalRequests)
+		}
+	}
+}
+
+func TestGCRADeny(t *testing.T) {
+	s, m, _ := newGCRAStrategy(t)
+	r := Request{Key: "deny", Limit: 2, Duration: time.Second, Algorithm: GCRA}
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.Run(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := m.Get(gcraPrefix + r.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.Run(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.State != Deny {
+		t.Fatal("expected to be denied")
+	}
+
+	if res.TotalRequests != 2 {
+		t.Fatalf("expected 2 total requests, got %d", res.TotalRequests)
+	}
+
+	if after, _ := m.Get(gcraPrefix + r.Key); after != before {
+		t.Fatalf("expected a denied request to leave the key as %s, got %s", before, after)
+	}
+}
+
+func TestGCRARetryAfter(t *testing.T) {
+	s, m, now := newGCRAStrategy(t)
+	r := Request{Key: "retry", Limit: 4, Duration: time.Second, Algorithm: GCRA}
+
+	for i := 0; i < 4; i++ {
+		if _, err := s.Run(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := s.Run(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request is let through once per emission interval
+	if d := time.Until(res.RetryAt); d <= 0 || d > 250*time.Millisecond {
+		t.Fatalf("expected to retry within the emission interval, got %v", d)
+	}
+
+	m.SetTime(now.Add(250 * time.Millisecond))
+
+	res, err = s.Run(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.State != Allow {
+		t.Fatal("expected to be allowed after the emission interval")
+	}
+
+	if res, _ = s.Run(context.Background(), r); res.State != Deny {
+		t.Fatal("expected only one request to be allowed after the emission interval")
+	}
+}
+
+func TestGCRAKeyTTL(t *testing.T) {
+	s, m, _ := newGCRAStrategy(t)
+	r := Request{Key: "ttl", Limit: 10, Duration: time.Second, Algorithm: GCRA}
+
+	if _, err := s.Run(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key lives until the bucket is full again
+	if d := m.TTL(gcraPrefix + r.Key); d != 100*time.Millisecond {
+		t.Fatalf("expected a ttl of one emission interval, got %v", d)
+	}
+
+	for i := 0; i < 9; i++ {
+		if _, err := s.Run(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d := m.TTL(gcraPrefix + r.Key); d != time.Second {
+		t.Fatalf("expected a ttl of the whole period, got %v", d)
+	}
+
+	m.FastForward(time.Second)
+
+	if m.Exists(gcraPrefix + r.Key) {
+		t.Fatal("expected the key to expire once the bucket is full")
+	}
+}
@@ -1,10 +1,16 @@
 package ratelimit
 
 import (
+	"context"
+	"encoding/json"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/mpraski/api-gateway/app/metrics"
 )
 
 type (
@@ -14,10 +20,57 @@ type (
 
 	Middleware func(http.Handler) http.Handler
 
+	// Failure decides what happens to the requests when the strategy fails,
+	// e.g. because Redis is unreachable.
+	Failure uint8
+
 	Config struct {
-		Limit    uint64
-		Duration time.Duration
+		// Route labels the metrics of the route.
+		Route string
+		// Namespace tells apart the keys of the routes, so that each route is
+		// limited separately, the route is used if empty.
+		Namespace string
+		// Key identifies the client the requests are counted for,
+		// the key function of the handler is used if empty.
+		Key       string
+		Limit     uint64
+		Duration  time.Duration
+		Algorithm Algorithm
+		Failure   Failure
+		// Timeout bounds the call of the strategy, DefaultTimeout if zero.
+		Timeout time.Duration
+		// LegacyHeaders are sent next to the standard ones for existing clients.
+		LegacyHeaders bool
 	}
+
+	tooManyRequests struct {
+		Code       int    `json:"code"`
+		Message    string `json:"message"`
+		RetryAfter int64  `json:"retryAfter"`
+	}
+)
+
+const (
+	// FailLocal counts the requests with the fallback strategy,
+	// usually in memory, so each replica limits them separately.
+	FailLocal Failure = iota
+	FailOpen
+	FailClosed
+)
+
+const DefaultTimeout = 100 * time.Millisecond
+
+// statusClientClosed is the non standard status of requests
+// the client gave up on before they were handled.
+const statusClientClosed = 499
+
+// The standard headers follow the RateLimit header fields for HTTP draft.
+const (
+	rateLimitLimit     = "RateLimit-Limit"
+	rateLimitRemaining = "RateLimit-Remaining"
+	rateLimitReset     = "RateLimit-Reset"
+	rateLimitPolicy    = "RateLimit-Policy"
+	retryAfter         = "Retry-After"
 )
 
 const (
@@ -26,66 +79,193 @@ const (
 	rateLimitingTotalRequests = "Rate-Limiting-Total-Requests"
 )
 
-func NewMiddleware(strategy Strategy, keyFunc KeyFunc, cfg Config) Middleware {
+const (
+	resultAllow = "allow"
+	resultDeny  = "deny"
+	resultError = "error"
+)
+
+var failureStr = []string{"local", "open", "closed"}
+
+func NewMiddleware(handle HandleFunc, cfg Config) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			k, err := keyFunc(r)
-			if err != nil {
+			if handle(w, r, cfg) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// NewHandler counts the requests with the strategy. While it fails, the
+// requests are handled according to the failure mode of the route, the
+// fallback strategy is used by FailLocal and is optional, without it the
+// requests are let through. The failures and the recovery of the strategies
+// are logged once.
+func NewHandler(strategy, fallback Strategy, keyFunc KeyFunc, logger *log.Logger) HandleFunc {
+	var failing, fallbackFailing atomic.Bool
+
+	return func(w http.ResponseWriter, r *http.Request, cfg Config) bool {
+		k := cfg.Key
+		if k == "" {
+			var err error
+
+			if k, err = keyFunc(r); err != nil {
 				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
+				return false
 			}
+		}
+
+		ns := cfg.Namespace
+		if ns == "" {
+			ns = cfg.Route
+		}
 
-			l, err := strategy.Run(r.Context(), Request{Key: k, Limit: cfg.Limit, Duration: cfg.Duration})
-			if err != nil {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
+		req := Request{
+			Key:       ns + ":" + k,
+			Limit:     cfg.Limit,
+			Duration:  cfg.Duration,
+			Algorithm: cfg.Algorithm,
+		}
+
+		l, err := run(r.Context(), strategy, req, cfg.Timeout)
+
+		switch {
+		case err == nil:
+			if failing.CompareAndSwap(true, false) {
+				logger.Println("rate limiting strategy recovered")
 			}
+		case r.Context().Err() != nil:
+			// The client is gone, but the request is still accounted for
+			w.WriteHeader(statusClientClosed)
+			return false
+		case cfg.Failure == FailLocal && fallback != nil:
+			failed(&failing, logger, cfg.Route, FailLocal, err)
 
-			e := w.Header()
+			if l, err = fallback.Run(r.Context(), req); err != nil {
+				if fallbackFailing.CompareAndSwap(false, true) {
+					logger.Printf("fallback rate limiting strategy failed, requests failing locally are let through: %v", err)
+				}
 
-			e.Set(rateLimitingState, stateStr[l.State])
-			e.Set(rateLimitingExpiresAt, l.ExpiresAt.Format(time.RFC3339))
-			e.Set(rateLimitingTotalRequests, strconv.FormatUint(l.TotalRequests, 10))
+				metrics.RateLimitDecisions.WithLabelValues(cfg.Route, resultError).Inc()
 
-			if l.State == Deny {
-				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-				return
+				return true
 			}
 
-			next.ServeHTTP(w, r)
-		})
-	}
-}
+			fallbackFailing.Store(false)
+		case cfg.Failure == FailClosed:
+			failed(&failing, logger, cfg.Route, FailClosed, err)
 
-func NewHandler(strategy Strategy, keyFunc KeyFunc) HandleFunc {
-	return func(w http.ResponseWriter, r *http.Request, cfg Config) bool {
-		k, err := keyFunc(r)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return false
-		}
+			metrics.RateLimitDecisions.WithLabelValues(cfg.Route, resultError).Inc()
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 
-		l, err := strategy.Run(r.Context(), Request{Key: k, Limit: cfg.Limit, Duration: cfg.Duration})
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return false
+		default:
+			// Routes failing locally fail open without a fallback to count in
+			if cfg.Failure == FailLocal && fallbackFailing.CompareAndSwap(false, true) {
+				logger.Printf("no fallback rate limiting strategy, requests failing locally are let through: %v", err)
+			}
+
+			failed(&failing, logger, cfg.Route, FailOpen, err)
+
+			metrics.RateLimitDecisions.WithLabelValues(cfg.Route, resultError).Inc()
+
+			return true
 		}
 
-		e := w.Header()
+		now := time.Now()
 
-		e.Set(rateLimitingState, stateStr[l.State])
-		e.Set(rateLimitingExpiresAt, l.ExpiresAt.Format(time.RFC3339))
-		e.Set(rateLimitingTotalRequests, strconv.FormatUint(l.TotalRequests, 10))
+		setHeaders(w.Header(), cfg, l, now)
 
 		if l.State == Deny {
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			metrics.RateLimitDecisions.WithLabelValues(cfg.Route, resultDeny).Inc()
+			deny(w, l, now)
+
 			return false
 		}
 
+		metrics.RateLimitDecisions.WithLabelValues(cfg.Route, resultAllow).Inc()
+
 		return true
 	}
 }
 
+func setHeaders(h http.Header, cfg Config, l Result, now time.Time) {
+	var remaining uint64
+	if l.TotalRequests < cfg.Limit {
+		remaining = cfg.Limit - l.TotalRequests
+	}
+
+	h.Set(rateLimitLimit, strconv.FormatUint(cfg.Limit, 10))
+	h.Set(rateLimitRemaining, strconv.FormatUint(remaining, 10))
+	h.Set(rateLimitReset, strconv.FormatInt(seconds(l.ExpiresAt.Sub(now)), 10))
+	h.Set(rateLimitPolicy, strconv.FormatUint(cfg.Limit, 10)+";w="+strconv.FormatInt(seconds(cfg.Duration), 10))
+
+	if cfg.LegacyHeaders {
+		h.Set(rateLimitingState, stateStr[l.State])
+		h.Set(rateLimitingExpiresAt, l.ExpiresAt.Format(time.RFC3339))
+		h.Set(rateLimitingTotalRequests, strconv.FormatUint(l.TotalRequests, 10))
+	}
+}
+
+// deny responds with 429 and tells the client when to retry.
+func deny(w http.ResponseWriter, l Result, now time.Time) {
+	at := l.RetryAt
+	if at.IsZero() {
+		at = l.ExpiresAt
+	}
+
+	// Retrying right away would be denied again
+	s := seconds(at.Sub(now))
+	if s < 1 {
+		s = 1
+	}
+
+	b, _ := json.Marshal(tooManyRequests{
+		Code:       http.StatusTooManyRequests,
+		Message:    http.StatusText(http.StatusTooManyRequests),
+		RetryAfter: s,
+	})
+
+	h := w.Header()
+
+	h.Set(retryAfter, strconv.FormatInt(s, 10))
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = w.Write(b)
+}
+
+// seconds rounds the duration up to whole seconds.
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+func run(ctx context.Context, strategy Strategy, r Request, timeout time.Duration) (Result, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return strategy.Run(ctx, r)
+}
+
+// failed counts the failure by the mode the request was handled in.
+func failed(failing *atomic.Bool, logger *log.Logger, route string, mode Failure, err error) {
+	metrics.RateLimitFailures.WithLabelValues(route, failureStr[mode]).Inc()
+
+	if failing.CompareAndSwap(false, true) {
+		logger.Printf("rate limiting strategy failed, requests are handled according to the failure mode of their route until it recovers: %v", err)
+	}
+}
+
 func KeyFromHeader(headers ...string) KeyFunc {
 	return func(r *http.Request) (string, error) {
 		var sb strings.Builder
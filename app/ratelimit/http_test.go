@@ -0,0 +1,249 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type strategyFunc func(context.Context, Request) (Result, error)
+
+func (f strategyFunc) Run(ctx context.Context, r Request) (Result, error) { return f(ctx, r) }
+
+var (
+	errStrategy = errors.New("strategy is down")
+
+	failing = strategyFunc(func(context.Context, Request) (Result, error) {
+		return Result{}, errStrategy
+	})
+
+	denying = strategyFunc(func(context.Context, Request) (Result, error) {
+		return Result{State: Deny, ExpiresAt: time.Now().Add(time.Minute)}, nil
+	})
+)
+
+func clientKey(*http.Request) (string, error) { return "client", nil }
+
+func TestHandlerFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fallback Strategy
+		failure  Failure
+		allowed  bool
+		code     int
+		logs     []string
+	}{
+		{
+			name:     "local counts with the fallback",
+			fallback: denying,
+			failure:  FailLocal,
+			code:     http.StatusTooManyRequests,
+			logs:     []string{"rate limiting strategy failed"},
+		},
+		{
+			name:    "local without a fallback fails open",
+			failure: FailLocal,
+			allowed: true,
+			code:    http.StatusOK,
+			logs:    []string{"no fallback rate limiting strategy", "rate limiting strategy failed"},
+		},
+		{
+			name:     "local with a failing fallback fails open",
+			fallback: failing,
+			failure:  FailLocal,
+			allowed:  true,
+			code:     http.StatusOK,
+			logs:     []string{"rate limiting strategy failed", "fallback rate limiting strategy failed"},
+		},
+		{
+			name:     "open lets the requests through",
+			fallback: denying,
+			failure:  FailOpen,
+			allowed:  true,
+			code:     http.StatusOK,
+			logs:     []string{"rate limiting strategy failed"},
+		},
+		{
+			name:     "closed rejects the requests",
+			fallback: denying,
+			failure:  FailClosed,
+			code:     http.StatusServiceUnavailable,
+			logs:     []string{"rate limiting strategy failed"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			h := NewHandler(failing, tc.fallback, clientKey, log.New(&logs, "", 0))
+
+			// Failures are only logged once
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+
+				allowed := h(w, httptest.NewRequest(http.MethodGet, "/", nil), Config{
+					Route:    "/",
+					Limit:    1,
+					Duration: time.Minute,
+					Failure:  tc.failure,
+				})
+
+				if allowed != tc.allowed {
+					t.Fatalf("expected allowed to be %t, got %t", tc.allowed, allowed)
+				}
+
+				if w.Code != tc.code {
+					t.Fatalf("expected status %d, got %d", tc.code, w.Code)
+				}
+			}
+
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) != len(tc.logs) {
+				t.Fatalf("expected %d log lines, got %q", len(tc.logs), lines)
+			}
+
+			for i, l := range lines {
+				if !strings.HasPrefix(l, tc.logs[i]) {
+					t.Fatalf("expected log line %d to start with %q, got %q", i, tc.logs[i], l)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerRecovery(t *testing.T) {
+	var (
+		logs bytes.Buffer
+		down = true
+	)
+
+	s := strategyFunc(func(context.Context, Request) (Result, error) {
+		if down {
+			return Result{}, errStrategy
+		}
+
+		return Result{State: Allow}, nil
+	})
+
+	h := NewHandler(s, nil, clientKey, log.New(&logs, "", 0))
+	cfg := Config{Route: "/", Limit: 1, Duration: time.Minute, Failure: FailOpen}
+
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), cfg)
+
+	down = false
+
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), cfg)
+
+	if !strings.Contains(logs.String(), "rate limiting strategy recovered") {
+		t.Fatalf("expected the recovery to be logged, got %q", logs.String())
+	}
+}
+
+func TestHandlerClientGone(t *testing.T) {
+	s := strategyFunc(func(ctx context.Context, _ Request) (Result, error) {
+		<-ctx.Done()
+		return Result{}, ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := httptest.NewRecorder()
+	h := NewHandler(s, nil, clientKey, log.New(&bytes.Buffer{}, "", 0))
+
+	if h(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx), Config{Route: "/", Limit: 1, Duration: time.Minute}) {
+		t.Fatal("expected the request to be stopped")
+	}
+
+	if w.Code != statusClientClosed {
+		t.Fatalf("expected status %d, got %d", statusClientClosed, w.Code)
+	}
+}
+
+func TestHandlerHeaders(t *testing.T) {
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name    string
+		result  Result
+		legacy  bool
+		code    int
+		headers map[string]string
+	}{
+		{
+			name:   "allowed",
+			result: Result{State: Allow, TotalRequests: 3, ExpiresAt: now.Add(29500 * time.Millisecond)},
+			code:   http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "7",
+				"RateLimit-Reset":     "30",
+				"RateLimit-Policy":    "10;w=60",
+				"Retry-After":         "",
+				"Rate-Limiting-State": "",
+			},
+		},
+		{
+			name:   "denied",
+			result: Result{State: Deny, TotalRequests: 12, ExpiresAt: now.Add(time.Minute), RetryAt: now.Add(4200 * time.Millisecond)},
+			code:   http.StatusTooManyRequests,
+			headers: map[string]string{
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "60",
+				"Retry-After":         "5",
+				"Content-Type":        "application/json",
+			},
+		},
+		{
+			name:    "denied until the window expires",
+			result:  Result{State: Deny, TotalRequests: 10, ExpiresAt: now.Add(9500 * time.Millisecond)},
+			code:    http.StatusTooManyRequests,
+			headers: map[string]string{"Retry-After": "10"},
+		},
+		{
+			name:    "denied right before the retry",
+			result:  Result{State: Deny, TotalRequests: 10, ExpiresAt: now, RetryAt: now},
+			code:    http.StatusTooManyRequests,
+			headers: map[string]string{"RateLimit-Reset": "0", "Retry-After": "1"},
+		},
+		{
+			name:   "legacy",
+			result: Result{State: Allow, TotalRequests: 1, ExpiresAt: now.Add(time.Minute)},
+			legacy: true,
+			code:   http.StatusOK,
+			headers: map[string]string{
+				"Rate-Limiting-State":          "Allow",
+				"Rate-Limiting-Expires-At":     now.Add(time.Minute).Format(time.RFC3339),
+				"Rate-Limiting-Total-Requests": "1",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := strategyFunc(func(context.Context, Request) (Result, error) { return tc.result, nil })
+			h := NewHandler(s, nil, clientKey, log.New(&bytes.Buffer{}, "", 0))
+			w := httptest.NewRecorder()
+
+			h(w, httptest.NewRequest(http.MethodGet, "/", nil), Config{
+				Route:         "/",
+				Limit:         10,
+				Duration:      time.Minute,
+				LegacyHeaders: tc.legacy,
+			})
+
+			if w.Code != tc.code {
+				t.Fatalf("expected status %d, got %d", tc.code, w.Code)
+			}
+
+			for k, v := range tc.headers {
+				if got := w.Header().Get(k); got != v {
+					t.Fatalf("expected %s to be %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
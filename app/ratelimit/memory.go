@@ -0,0 +1,202 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	// MemoryStrategy limits the requests in process, so each replica of
+	// the gateway counts its requests separately. The keys are spread over
+	// shards to reduce lock contention and idle keys are evicted in the
+	// background. GCRA is exact, while the sliding window is approximated
+	// by weighing the count of the previous window, so both use O(1) memory
+	// per key.
+	MemoryStrategy struct {
+		seed   maphash.Seed
+		shards [memoryShards]memoryShard
+		done   chan struct{}
+	}
+
+	memoryShard struct {
+		mu      sync.Mutex
+		entries map[memoryKey]*memoryEntry
+	}
+
+	memoryKey struct {
+		key       string
+		algorithm Algorithm
+	}
+
+	memoryEntry struct {
+		// tat is the theoretical arrival time of GCRA
+		tat time.Time
+		// window is the start of the current sliding window
+		window   time.Time
+		current  uint64
+		previous uint64
+		// idleAt is when the entry no longer affects any decision
+		idleAt time.Time
+	}
+)
+
+const memoryShards = 64
+
+var _ Strategy = (*MemoryStrategy)(nil)
+
+// NewMemoryStrategy evicts the idle keys every interval until closed.
+func NewMemoryStrategy(interval time.Duration) *MemoryStrategy {
+	s := MemoryStrategy{seed: maphash.MakeSeed(), done: make(chan struct{})}
+
+	for i := range s.shards {
+		s.shards[i].entries = make(map[memoryKey]*memoryEntry)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case t := <-ticker.C:
+				s.evict(t)
+			}
+		}
+	}()
+
+	return &s
+}
+
+func (s *MemoryStrategy) Close() { close(s.done) }
+
+func (s *MemoryStrategy) Run(_ context.Context, r Request) (Result, error) {
+	var (
+		now   = time.Now().UTC()
+		k     = memoryKey{key: r.Key, algorithm: r.Algorithm}
+		shard = &s.shards[maphash.String(s.seed, r.Key)%memoryShards]
+	)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	e, ok := shard.entries[k]
+	if !ok {
+		e = &memoryEntry{}
+		shard.entries[k] = e
+	}
+
+	switch r.Algorithm {
+	case GCRA:
+		return e.gcra(now, r), nil
+	case SlidingWindow:
+		return e.slidingWindow(now, r), nil
+	default:
+		delete(shard.entries, k)
+		return Result{}, fmt.Errorf("%w: %d", ErrUnsupportedAlgorithm, r.Algorithm)
+	}
+}
+
+func (e *memoryEntry) gcra(now time.Time, r Request) Result {
+	emission := r.Duration / time.Duration(r.Limit)
+	if emission == 0 {
+		emission = 1
+	}
+
+	tat := e.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	next := tat.Add(emission)
+
+	if allowAt := next.Add(-r.Duration); allowAt.After(now) {
+		return Result{
+			State:         Deny,
+			ExpiresAt:     tat,
+			RetryAt:       allowAt,
+			TotalRequests: uint64((tat.Sub(now) + emission - 1) / emission),
+		}
+	}
+
+	e.tat, e.idleAt = next, next
+
+	return Result{
+		State:         Allow,
+		ExpiresAt:     next,
+		TotalRequests: uint64((next.Sub(now) + emission - 1) / emission),
+	}
+}
+
+// slidingWindow estimates the requests of the last duration assuming
+// the requests of the previous window were evenly distributed.
+func (e *memoryEntry) slidingWindow(now time.Time, r Request) Result {
+	switch elapsed := now.Sub(e.window); {
+	case elapsed >= 2*r.Duration:
+		e.window, e.current, e.previous = now, 0, 0
+	case elapsed >= r.Duration:
+		e.window, e.current, e.previous = e.window.Add(r.Duration), 0, e.current
+	}
+
+	var (
+		weight   = 1 - float64(now.Sub(e.window))/float64(r.Duration)
+		estimate = float64(e.previous)*weight + float64(e.current)
+		res      = Result{
+			State:         Deny,
+			ExpiresAt:     now.Add(r.Duration),
+			TotalRequests: uint64(math.Ceil(estimate)),
+		}
+	)
+
+	if estimate >= float64(r.Limit) {
+		res.RetryAt = e.retryAt(r)
+		return res
+	}
+
+	e.current++
+	e.idleAt = e.window.Add(2 * r.Duration)
+
+	res.State = Allow
+	res.TotalRequests = uint64(math.Ceil(estimate + 1))
+
+	return res
+}
+
+// retryAt is when the weight of the previous window has declined enough
+// for the estimate to drop below the limit.
+func (e *memoryEntry) retryAt(r Request) time.Time {
+	var (
+		limit    = float64(r.Limit)
+		window   = e.window
+		previous = float64(e.previous)
+		current  = float64(e.current)
+	)
+
+	// The current window is full, so it has to become the previous one
+	if current >= limit {
+		window, previous, current = window.Add(r.Duration), current, 0
+	}
+
+	return window.Add(time.Duration(float64(r.Duration) * (1 - (limit-current)/previous)))
+}
+
+func (s *MemoryStrategy) evict(now time.Time) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+
+		shard.mu.Lock()
+
+		for k, e := range shard.entries {
+			if e.idleAt.Before(now) {
+				delete(shard.entries, k)
+			}
+		}
+
+		shard.mu.Unlock()
+	}
+}
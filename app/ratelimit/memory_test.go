@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func entries(s *MemoryStrategy) int {
+	var n int
+
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+		n += len(s.shards[i].entries)
+		s.shards[i].mu.Unlock()
+	}
+
+	return n
+}
+
+func TestMemoryEviction(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		algorithm Algorithm
+		requests  int
+		after     time.Duration
+		kept      bool
+	}{
+		// A GCRA key is idle once the bucket is full again
+		{name: "gcra in use", algorithm: GCRA, requests: 2, after: 150 * time.Millisecond, kept: true},
+		{name: "gcra idle", algorithm: GCRA, requests: 2, after: 250 * time.Millisecond},
+		// A sliding window key is idle once its window no longer weighs in
+		{name: "sliding window in use", algorithm: SlidingWindow, requests: 2, after: 1500 * time.Millisecond, kept: true},
+		{name: "sliding window idle", algorithm: SlidingWindow, requests: 2, after: 2100 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewMemoryStrategy(time.Hour)
+			t.Cleanup(s.Close)
+
+			r := Request{Key: "client", Limit: 10, Duration: time.Second, Algorithm: tc.algorithm}
+			start := time.Now()
+
+			for i := 0; i < tc.requests; i++ {
+				if _, err := s.Run(context.Background(), r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s.evict(start.Add(tc.after))
+
+			if kept := entries(s) == 1; kept != tc.kept {
+				t.Fatalf("expected kept to be %t, got %t", tc.kept, kept)
+			}
+		})
+	}
+}
+
+func TestMemoryUnsupportedAlgorithm(t *testing.T) {
+	s := NewMemoryStrategy(time.Hour)
+	t.Cleanup(s.Close)
+
+	_, err := s.Run(context.Background(), Request{Key: "client", Limit: 1, Duration: time.Second, Algorithm: Algorithm(math.MaxUint8)})
+	if !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedAlgorithm, err)
+	}
+
+	if n := entries(s); n != 0 {
+		t.Fatalf("expected no entries, got %d", n)
+	}
+}
@@ -2,6 +2,8 @@ package ratelimit
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 )
 
@@ -10,17 +12,26 @@ type (
 		Run(context.Context, Request) (Result, error)
 	}
 
+	// Strategies run the strategy implementing the algorithm of the request.
+	Strategies map[Algorithm]Strategy
+
 	State uint8
 
+	Algorithm uint8
+
 	Request struct {
-		Key      string
-		Limit    uint64
-		Duration time.Duration
+		Key       string
+		Limit     uint64
+		Duration  time.Duration
+		Algorithm Algorithm
 	}
 
 	Result struct {
-		State         State
-		ExpiresAt     time.Time
+		State State
+		// ExpiresAt is when the requests counted so far no longer count.
+		ExpiresAt time.Time
+		// RetryAt is when a denied request may be retried.
+		RetryAt       time.Time
 		TotalRequests uint64
 	}
 )
@@ -30,4 +41,22 @@ const (
 	Allow
 )
 
+const (
+	SlidingWindow Algorithm = iota
+	GCRA
+)
+
 var stateStr = []string{"Deny", "Allow"}
+
+var ErrUnsupportedAlgorithm = errors.New("unsupported rate limiting algorithm")
+
+var _ Strategy = Strategies(nil)
+
+func (s Strategies) Run(ctx context.Context, r Request) (Result, error) {
+	t, ok := s[r.Algorithm]
+	if !ok {
+		return Result{}, fmt.Errorf("%w: %d", ErrUnsupportedAlgorithm, r.Algorithm)
+	}
+
+	return t.Run(ctx, r)
+}
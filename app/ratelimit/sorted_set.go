@@ -41,6 +41,8 @@ func (s *SortedSetStrategy) Run(ctx context.Context, r Request) (Result, error)
 	c, err := s.client.ZCount(ctx, r.Key, strconv.FormatInt(minimum.UnixMilli(), 10), sortedSetMax).Uint64()
 	if err == nil && c >= r.Limit {
 		res.TotalRequests = c
+		res.RetryAt = s.retryAt(ctx, r, minimum, c)
+
 		return res, nil
 	}
 
@@ -78,6 +80,7 @@ func (s *SortedSetStrategy) Run(ctx context.Context, r Request) (Result, error)
 	res.TotalRequests = uint64(total)
 
 	if res.TotalRequests > r.Limit {
+		res.RetryAt = s.retryAt(ctx, r, minimum, res.TotalRequests)
 		return res, nil
 	}
 
@@ -85,3 +88,19 @@ func (s *SortedSetStrategy) Run(ctx context.Context, r Request) (Result, error)
 
 	return res, nil
 }
+
+// retryAt is when enough requests of the window have expired for the count
+// of the key to drop below the limit, or the end of the window if unknown.
+func (s *SortedSetStrategy) retryAt(ctx context.Context, r Request, minimum time.Time, count uint64) time.Time {
+	z, err := s.client.ZRangeByScoreWithScores(ctx, r.Key, &redis.ZRangeBy{
+		Min:    strconv.FormatInt(minimum.UnixMilli(), 10),
+		Max:    sortedSetMax,
+		Offset: int64(count - r.Limit),
+		Count:  1,
+	}).Result()
+	if err != nil || len(z) == 0 {
+		return minimum.Add(2 * r.Duration)
+	}
+
+	return time.UnixMilli(int64(z[0].Score)).Add(r.Duration).UTC()
+}
@@ -0,0 +1,295 @@
+package token
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mpraski/api-gateway/app/metrics"
+	"golang.org/x/sync/singleflight"
+)
+
+type (
+	Provider interface {
+		GetIdentity(context.Context, string) (string, error)
+	}
+
+	CacheConfig struct {
+		// Size is the maximum number of entries kept in memory.
+		Size int
+		// MaxTTL caps how long an identity token is cached,
+		// regardless of its expiry.
+		MaxTTL time.Duration
+		// NegativeTTL is how long invalid sessions are cached.
+		NegativeTTL time.Duration
+		// Timeout bounds a lookup shared by concurrent callers,
+		// which must not depend on any of their contexts.
+		Timeout time.Duration
+	}
+
+	// Cache caches identity tokens in memory and optionally in Redis.
+	// Entries are keyed by a hash of the access token, so the access
+	// tokens themselves are never stored.
+	Cache struct {
+		provider Provider
+		redis    *redis.Client
+		config   CacheConfig
+		group    singleflight.Group
+
+		mu      sync.Mutex
+		entries map[string]*list.Element
+		order   *list.List
+	}
+
+	cacheEntry struct {
+		key       string
+		identity  string
+		invalid   bool
+		expiresAt time.Time
+	}
+)
+
+const (
+	redisKeyPrefix = "identity:"
+	invalidMarker  = "-"
+	cacheHit       = "hit"
+	cacheMiss      = "miss"
+)
+
+var _ Provider = (*Cache)(nil)
+
+func NewCache(provider Provider, redisClient *redis.Client, config CacheConfig) *Cache {
+	return &Cache{
+		provider: provider,
+		redis:    redisClient,
+		config:   config,
+		entries:  make(map[string]*list.Element, config.Size),
+		order:    list.New(),
+	}
+}
+
+func (c *Cache) GetIdentity(ctx context.Context, accessToken string) (string, error) {
+	key := hashToken(accessToken)
+
+	if e, ok := c.get(key); ok {
+		metrics.IdentityCacheLookups.WithLabelValues(cacheHit).Inc()
+		return e.result()
+	}
+
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := c.lookupContext()
+		defer cancel()
+
+		if e, ok := c.getRemote(ctx, key); ok {
+			c.put(e)
+			return e, nil
+		}
+
+		metrics.IdentityCacheLookups.WithLabelValues(cacheMiss).Inc()
+
+		i, err := c.provider.GetIdentity(ctx, accessToken)
+
+		switch {
+		// Only answers of the identity service are cached, not its failures
+		case errors.Is(err, ErrSessionRejected):
+			e := &cacheEntry{key: key, invalid: true, expiresAt: time.Now().Add(c.config.NegativeTTL)}
+
+			c.put(e)
+			c.putRemote(ctx, e)
+
+			return e, nil
+		case err != nil:
+			return nil, err
+		}
+
+		e := &cacheEntry{key: key, identity: i, expiresAt: c.expiresAt(i)}
+
+		c.put(e)
+		c.putRemote(ctx, e)
+
+		return e, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case r := <-ch:
+		if r.Err != nil {
+			return "", r.Err
+		}
+
+		//nolint:errcheck //always known
+		return r.Val.(*cacheEntry).result()
+	}
+}
+
+// lookupContext is detached from the caller that started the lookup,
+// so that its cancellation does not fail the others waiting for it.
+func (c *Cache) lookupContext() (context.Context, context.CancelFunc) {
+	if c.config.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), c.config.Timeout)
+}
+
+func (c *Cache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	//nolint:errcheck //always known
+	e := el.Value.(*cacheEntry)
+
+	if time.Now().After(e.expiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+
+	return e, true
+}
+
+func (c *Cache) put(e *cacheEntry) {
+	if !e.expiresAt.After(time.Now()) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+
+		return
+	}
+
+	c.entries[e.key] = c.order.PushFront(e)
+
+	for c.order.Len() > c.config.Size {
+		el := c.order.Back()
+
+		c.order.Remove(el)
+		//nolint:errcheck //always known
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *Cache) getRemote(ctx context.Context, key string) (*cacheEntry, bool) {
+	if c.redis == nil {
+		return nil, false
+	}
+
+	p := c.redis.Pipeline()
+
+	get := p.Get(ctx, redisKeyPrefix+key)
+	ttl := p.PTTL(ctx, redisKeyPrefix+key)
+
+	if _, err := p.Exec(ctx); err != nil {
+		return nil, false
+	}
+
+	v, d := get.Val(), ttl.Val()
+	if v == "" || d <= 0 {
+		return nil, false
+	}
+
+	e := &cacheEntry{key: key, expiresAt: time.Now().Add(d)}
+
+	if v == invalidMarker {
+		e.invalid = true
+	} else {
+		e.identity = v
+	}
+
+	return e, true
+}
+
+func (c *Cache) putRemote(ctx context.Context, e *cacheEntry) {
+	if c.redis == nil {
+		return
+	}
+
+	d := time.Until(e.expiresAt)
+	if d <= 0 {
+		return
+	}
+
+	v := e.identity
+	if e.invalid {
+		v = invalidMarker
+	}
+
+	// The remote tier is best effort, the in-memory entry is already in place
+	_ = c.redis.Set(ctx, redisKeyPrefix+e.key, v, d).Err()
+}
+
+// expiresAt honours the expiry of the identity token if it is a JWT,
+// but never caches it for longer than the configured maximum.
+func (c *Cache) expiresAt(identityToken string) time.Time {
+	e := time.Now().Add(c.config.MaxTTL)
+
+	if exp, ok := tokenExpiry(identityToken); ok && exp.Before(e) {
+		return exp
+	}
+
+	return e
+}
+
+func (e *cacheEntry) result() (string, error) {
+	if e.invalid {
+		return "", ErrSessionRejected
+	}
+
+	return e.identity, nil
+}
+
+func hashToken(t string) string {
+	s := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(s[:])
+}
+
+// tokenExpiry reads the exp claim of a JWT without verifying it,
+// the identity token comes from a trusted service.
+func tokenExpiry(t string) (time.Time, bool) {
+	parts := strings.Split(t, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var c struct {
+		Exp *json.Number `json:"exp"`
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil || c.Exp == nil {
+		return time.Time{}, false
+	}
+
+	f, err := c.Exp.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(f), 0), true
+}
@@ -24,7 +24,15 @@ type (
 	}
 )
 
-var ErrInvalidSession = errors.New("session is invalid")
+var (
+	ErrInvalidSession = errors.New("session is invalid")
+	// ErrSessionRejected is returned when the identity service answers that
+	// the session is not valid, unlike any failure of the service itself.
+	ErrSessionRejected  = fmt.Errorf("%w: rejected by the identity service", ErrInvalidSession)
+	ErrUnexpectedStatus = errors.New("identity service responded with unexpected status")
+)
+
+var _ Provider = (*Client)(nil)
 
 func NewClient(baseURL string, client *http.Client) *Client {
 	return &Client{baseURL: baseURL, client: client}
@@ -52,8 +60,13 @@ func (c *Client) GetIdentity(ctx context.Context, accessToken string) (string, e
 
 	defer s.Body.Close()
 
-	if s.StatusCode != http.StatusOK {
-		return "", ErrInvalidSession
+	switch s.StatusCode {
+	case http.StatusOK:
+		break
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", ErrSessionRejected
+	default:
+		return "", fmt.Errorf("%w: %d", ErrUnexpectedStatus, s.StatusCode)
 	}
 
 	var i response
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -13,6 +15,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -22,6 +25,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/hellofresh/health-go/v4"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/mpraski/api-gateway/app/metrics"
 	"github.com/mpraski/api-gateway/app/proxy"
 	"github.com/mpraski/api-gateway/app/ratelimit"
 	"github.com/mpraski/api-gateway/app/secret"
@@ -32,10 +36,12 @@ import (
 )
 
 type config struct {
-	Debug  bool
-	Delay  time.Duration `default:"1s"`
-	Config string        `required:"true"`
-	Server struct {
+	Debug        bool
+	Delay        time.Duration `default:"1s"`
+	Config       string
+	ConfigFile   string        `split_words:"true"`
+	ConfigReload time.Duration `split_words:"true" default:"10s"`
+	Server       struct {
 		Address struct {
 			Public        string `default:":8080"`
 			Observability string `default:":9090"`
@@ -50,7 +56,19 @@ type config struct {
 	Identity struct {
 		BaseURL string        `required:"true" split_words:"true"`
 		Timeout time.Duration `default:"15s"`
+		Cache   struct {
+			Enabled     bool          `default:"true"`
+			Redis       bool          `default:"false"`
+			Size        int           `default:"10000"`
+			MaxTTL      time.Duration `split_words:"true" default:"5m"`
+			NegativeTTL time.Duration `split_words:"true" default:"10s"`
+		}
 	}
+	RateLimit struct {
+		// Store is either redis, shared by all replicas, or memory
+		Store    string        `default:"redis"`
+		Eviction time.Duration `default:"1m"`
+	} `split_words:"true"`
 	Redis struct {
 		Address  string
 		Database int `default:"0"`
@@ -71,7 +89,12 @@ var (
 	errShutdown           = errors.New("shutdown in progress")
 	errTooManyGoroutines  = errors.New("too many goroutines")
 	errRedisMisconfigured = errors.New("redis is misconfigured")
+	errRateLimitStore     = errors.New("rate limit store is invalid")
+	errRateLimitEviction  = errors.New("rate limit eviction interval must be positive")
+	errIdentityCacheSize  = errors.New("identity cache size must be positive")
 	errCertificateInvalid = errors.New("failed to decode PEM certificate")
+	errConfigMissing      = errors.New("either config or config file is required")
+	errUpstreamsDown      = errors.New("upstreams have no available endpoints")
 )
 
 func main() {
@@ -114,32 +137,58 @@ func run(ctx context.Context, cfg *config, lg *logging.Logger) error {
 	var (
 		appLog = lg.StandardLogger(logging.Info)
 		errLog = lg.StandardLogger(logging.Critical)
-		client = token.NewClient(cfg.Identity.BaseURL, &http.Client{Timeout: cfg.Identity.Timeout})
 	)
 
-	rateLimiter, closer, err := newRateLimiter(ctx, cfg)
+	secrets, closeSecrets, err := newSecretSource(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to initialize rate limiter: %w", err)
+		return fmt.Errorf("failed to initialize secret source: %w", err)
+	}
+
+	defer closeSecrets()
+
+	redisClient, closer, err := newRedisClient(ctx, cfg, secrets)
+	if err != nil {
+		return fmt.Errorf("failed to initialize redis client: %w", err)
 	}
 
 	defer func() {
 		if err = closer(); err != nil {
-			errLog.Fatalf("failed to close rate limiter: %v", err)
+			errLog.Fatalf("failed to close redis client: %v", err)
 		}
 	}()
 
-	if rateLimiter == nil {
-		appLog.Println("not using rate limiting")
-	} else {
-		appLog.Println("using rate limiting")
+	rateLimiter, store, closeRateLimiter, err := newRateLimiter(cfg, redisClient, lg.StandardLogger(logging.Warning))
+	if err != nil {
+		return fmt.Errorf("failed to initialize rate limiter: %w", err)
+	}
+
+	defer closeRateLimiter()
+
+	appLog.Println("using rate limiting with store", store)
+
+	client, err := newTokenProvider(cfg, redisClient)
+	if err != nil {
+		return fmt.Errorf("failed to initialize token provider: %w", err)
 	}
 
-	p, err := proxy.New(cfg.Config, client, lg, rateLimiter)
+	configData, err := loadConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load proxy config: %w", err)
+	}
+
+	p, err := proxy.New(string(configData), client, secrets, lg, rateLimiter)
 	if err != nil {
 		return fmt.Errorf("failed to initialize proxy: %w", err)
 	}
 
-	checks, err := newHealthChecks()
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+
+	if cfg.ConfigFile != "" {
+		go watchConfig(watchCtx, cfg, p, configData, appLog, errLog)
+	}
+
+	checks, err := newHealthChecks(p)
 	if err != nil {
 		return fmt.Errorf("failed to setup health checks: %w", err)
 	}
@@ -163,6 +212,8 @@ func run(ctx context.Context, cfg *config, lg *logging.Logger) error {
 		observabilityServer = newServer(ctx, cfg, cfg.Server.Address.Observability, func(m *http.ServeMux) {
 			m.Handle("/livez", checks[0])
 			m.Handle("/readyz", checks[1])
+			m.Handle("/metrics", metrics.Handler())
+			m.Handle("/upstreams", upstreamsHandler(p))
 		})
 		runServer = func(server *http.Server) {
 			warm.Done()
@@ -239,7 +290,7 @@ func newServer(ctx context.Context, cfg *config, address string, f func(*http.Se
 
 const maxGoroutines = 1000
 
-func newHealthChecks() ([2]http.Handler, error) {
+func newHealthChecks(p *proxy.Proxy) ([2]http.Handler, error) {
 	l, err := health.New(health.WithChecks(
 		health.Config{
 			Name:    "goroutine",
@@ -270,6 +321,21 @@ func newHealthChecks() ([2]http.Handler, error) {
 				return nil
 			},
 		},
+		health.Config{
+			Name:      "upstreams",
+			Timeout:   time.Second,
+			SkipOnErr: true,
+			Check: func(_ context.Context) error {
+				return checkUpstreams(p, false)
+			},
+		},
+		health.Config{
+			Name:    "critical-upstreams",
+			Timeout: time.Second,
+			Check: func(_ context.Context) error {
+				return checkUpstreams(p, true)
+			},
+		},
 	))
 
 	if err != nil {
@@ -279,25 +345,140 @@ func newHealthChecks() ([2]http.Handler, error) {
 	return [2]http.Handler{l.Handler(), r.Handler()}, nil
 }
 
+// checkUpstreams fails if any of the upstream pools has no available endpoints,
+// only pools marked as critical make the gateway not ready.
+func checkUpstreams(p *proxy.Proxy, critical bool) error {
+	var down []string
+
+	for _, u := range p.Upstreams() {
+		if u.Healthy == 0 && (u.Critical || !critical) {
+			down = append(down, u.Name)
+		}
+	}
+
+	if len(down) > 0 {
+		return fmt.Errorf("%w: %s", errUpstreamsDown, strings.Join(down, ", "))
+	}
+
+	return nil
+}
+
+func upstreamsHandler(p *proxy.Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Upstreams())
+	})
+}
+
+func loadConfig(cfg *config) ([]byte, error) {
+	if cfg.ConfigFile == "" {
+		if cfg.Config == "" {
+			return nil, errConfigMissing
+		}
+
+		return []byte(cfg.Config), nil
+	}
+
+	b, err := os.ReadFile(cfg.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	return b, nil
+}
+
+// watchConfig reloads the proxy whenever the contents of the config file change
+// (e.g. when kubelet updates a mounted ConfigMap) or when SIGHUP is received.
+// Invalid configurations are rejected and the proxy keeps serving the last valid one.
+func watchConfig(ctx context.Context, cfg *config, p *proxy.Proxy, current []byte, appLog, errLog *log.Logger) {
+	var (
+		last = sha256.Sum256(current)
+		hup  = make(chan os.Signal, 1)
+		tick <-chan time.Time
+	)
+
+	// The file is only reloaded on SIGHUP if polling is disabled
+	if cfg.ConfigReload > 0 {
+		ticker := time.NewTicker(cfg.ConfigReload)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	reload := func(force bool) {
+		b, err := os.ReadFile(cfg.ConfigFile)
+		if err != nil {
+			errLog.Printf("failed to read config file %s: %v", cfg.ConfigFile, err)
+			return
+		}
+
+		sum := sha256.Sum256(b)
+		if !force && sum == last {
+			return
+		}
+
+		last = sum
+
+		if err := p.Reload(string(b)); err != nil {
+			errLog.Printf("failed to reload config from %s, keeping previous one: %v", cfg.ConfigFile, err)
+			return
+		}
+
+		appLog.Println("reloaded config from", cfg.ConfigFile)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reload(true)
+		case <-tick:
+			reload(false)
+		}
+	}
+}
+
+const (
+	rateLimitRedis  = "redis"
+	rateLimitMemory = "memory"
+)
+
 var emptyCloseFunc = func() error { return nil }
 
-func newRateLimiter(ctx context.Context, cfg *config) (ratelimit.HandleFunc, func() error, error) {
+// newSecretSource reads secrets from the environment in debug mode
+// and from Google Secret Manager otherwise.
+func newSecretSource(ctx context.Context, cfg *config) (secret.Source, func(), error) {
 	if cfg.Debug {
-		return nil, emptyCloseFunc, nil
+		return secret.NewEnvSource(), func() {}, nil
 	}
 
-	if cfg.Redis.Address == "" || cfg.Secrets.RedisCertificate == "" {
-		return nil, emptyCloseFunc, errRedisMisconfigured
+	gsm, err := secret.NewGoogleSecretManager(ctx, cfg.Project.ID)
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("failed to connect to GSM: %w", err)
+	}
+
+	return gsm, gsm.Close, nil
+}
+
+func newRedisClient(ctx context.Context, cfg *config, secrets secret.Source) (*redis.Client, func() error, error) {
+	if cfg.Debug {
+		return nil, emptyCloseFunc, nil
 	}
 
-	gsm, gerr := secret.NewGoogleSecretManager(ctx, cfg.Project.ID)
-	if gerr != nil {
-		return nil, emptyCloseFunc, fmt.Errorf("failed to connect to GSM: %w", gerr)
+	// Redis is only used by the rate limiter and the identity cache
+	if cfg.RateLimit.Store == rateLimitMemory && !(cfg.Identity.Cache.Enabled && cfg.Identity.Cache.Redis) {
+		return nil, emptyCloseFunc, nil
 	}
 
-	defer gsm.Close()
+	if cfg.Redis.Address == "" || cfg.Secrets.RedisCertificate == "" {
+		return nil, emptyCloseFunc, errRedisMisconfigured
+	}
 
-	redisCert, rerr := gsm.Get(ctx, cfg.Secrets.RedisCertificate)
+	redisCert, rerr := secrets.Get(ctx, cfg.Secrets.RedisCertificate)
 	if rerr != nil {
 		return nil, emptyCloseFunc, fmt.Errorf("failed to fetch redis certificate: %w", rerr)
 	}
@@ -328,19 +509,78 @@ func newRateLimiter(ctx context.Context, cfg *config) (ratelimit.HandleFunc, fun
 		return nil, emptyCloseFunc, fmt.Errorf("failed to ping redis: %w", err)
 	}
 
-	var (
-		rateLimiter = ratelimit.NewHandler(
-			ratelimit.NewSortedSetStrategy(redisClient),
-			ratelimit.KeyFromHeader("X-Forwarded-For"),
-		)
-		closeFunc = func() error {
-			if err := redisClient.Close(); err != nil {
-				return fmt.Errorf("failed to close redis client: %w", err)
-			}
+	closeFunc := func() error {
+		if err := redisClient.Close(); err != nil {
+			return fmt.Errorf("failed to close redis client: %w", err)
+		}
+
+		return nil
+	}
+
+	return redisClient, closeFunc, nil
+}
+
+// newRateLimiter limits the requests in memory if configured or if Redis
+// is not available in debug mode. Otherwise the requests are limited in
+// Redis, falling back to memory on routes failing locally.
+func newRateLimiter(cfg *config, redisClient *redis.Client, logger *log.Logger) (ratelimit.HandleFunc, string, func(), error) {
+	store := cfg.RateLimit.Store
+	if store != rateLimitRedis && store != rateLimitMemory {
+		return nil, "", nil, fmt.Errorf("%w: %q", errRateLimitStore, store)
+	}
+
+	if cfg.RateLimit.Eviction <= 0 {
+		return nil, "", nil, fmt.Errorf("%w: %s", errRateLimitEviction, cfg.RateLimit.Eviction)
+	}
 
-			return nil
+	var (
+		m     = ratelimit.NewMemoryStrategy(cfg.RateLimit.Eviction)
+		local = ratelimit.Strategies{
+			ratelimit.SlidingWindow: m,
+			ratelimit.GCRA:          m,
 		}
+		strategy ratelimit.Strategy = local
+		fallback ratelimit.Strategy
 	)
 
-	return rateLimiter, closeFunc, nil
+	if store == rateLimitRedis && redisClient != nil {
+		strategy = ratelimit.Strategies{
+			ratelimit.SlidingWindow: ratelimit.NewSortedSetStrategy(redisClient),
+			ratelimit.GCRA:          ratelimit.NewGCRAStrategy(redisClient),
+		}
+		fallback = local
+	} else {
+		store = rateLimitMemory
+	}
+
+	return ratelimit.NewHandler(
+		strategy,
+		fallback,
+		// Routes compose their keys, the client IP is resolved through the trusted proxies
+		func(r *http.Request) (string, error) { return proxy.ClientIP(r), nil },
+		logger,
+	), store, m.Close, nil
+}
+
+func newTokenProvider(cfg *config, redisClient *redis.Client) (token.Provider, error) {
+	client := token.NewClient(cfg.Identity.BaseURL, &http.Client{Timeout: cfg.Identity.Timeout})
+
+	if !cfg.Identity.Cache.Enabled {
+		return client, nil
+	}
+
+	if cfg.Identity.Cache.Size <= 0 {
+		return nil, fmt.Errorf("%w: %d", errIdentityCacheSize, cfg.Identity.Cache.Size)
+	}
+
+	if !cfg.Identity.Cache.Redis {
+		redisClient = nil
+	}
+
+	return token.NewCache(client, redisClient, token.CacheConfig{
+		Size:        cfg.Identity.Cache.Size,
+		MaxTTL:      cfg.Identity.Cache.MaxTTL,
+		NegativeTTL: cfg.Identity.Cache.NegativeTTL,
+		Timeout:     cfg.Identity.Timeout,
+	}), nil
 }